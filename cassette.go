@@ -0,0 +1,92 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Cassettes
+
+// A cassette is a file holding the recordings of commands run with --record: for each command
+// the command line, the exit code, what was printed, and all the HTTP interactions it performed
+// in order, for example the oauth2 request followed by the actual API call, or the requests to
+// RL10 and the platform needed to resolve the self href. Each invocation of rs-api appends
+// one json object to the cassette, so a cassette is a sequence of json objects rather than a
+// single json document. Recordings made before interactions were introduced hold a single
+// request in RR, which is moved into Interactions when reading the cassette.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// readCassette reads all the command recordings in a cassette file
+func readCassette(filename string) ([]MyRecording, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recs, err := decodeCassette(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return recs, nil
+}
+
+// decodeCassette decodes the sequence of command recordings in a cassette
+func decodeCassette(r io.Reader) ([]MyRecording, error) {
+	recs := []MyRecording{}
+	dec := json.NewDecoder(r)
+	for {
+		var rec MyRecording
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("recording #%d: %s", len(recs)+1, err.Error())
+		}
+		if rec.RR != nil {
+			rec.Interactions = append([]RequestRecording{*rec.RR}, rec.Interactions...)
+			rec.RR = nil
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// encodeRecording appends a command recording to a cassette
+func encodeRecording(w io.Writer, r MyRecording) error {
+	js, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\n%s\n", js)
+	return err
+}
+
+// writeCassette replaces the content of a cassette file with the recordings, keeping the mode
+// of the file
+func writeCassette(filename string, recs []MyRecording) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".cassette")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if fi, err := os.Stat(filename); err == nil {
+		if err := f.Chmod(fi.Mode()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, r := range recs {
+		if err := encodeRecording(f, r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
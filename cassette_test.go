@@ -0,0 +1,61 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cassettes", func() {
+
+	It("reads a sequence of recordings with their interactions in order", func() {
+		recs, err := decodeCassette(strings.NewReader(`
+			{"CmdArgs":["index","clouds"],"Interactions":[
+			  {"Verb":"POST","Uri":"https://h/api/oauth2"},{"Verb":"GET","Uri":"https://h/api/clouds"}]}
+			{"CmdArgs":["show","self"],"ExitCode":1,"Interactions":[]}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recs).Should(HaveLen(2))
+		Ω(recs[0].Interactions).Should(HaveLen(2))
+		Ω(recs[0].Interactions[1].Uri).Should(Equal("https://h/api/clouds"))
+		Ω(recs[1].ExitCode).Should(Equal(1))
+	})
+
+	It("upgrades recordings holding a single request", func() {
+		recs, err := decodeCassette(strings.NewReader(
+			`{"CmdArgs":["show","clouds/1"],"RR":{"Verb":"GET","Uri":"https://h/api/clouds/1"}}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recs[0].RR).Should(BeNil())
+		Ω(recs[0].Interactions).Should(Equal([]RequestRecording{
+			{Verb: "GET", Uri: "https://h/api/clouds/1"}}))
+	})
+
+	It("records every interaction without the api key", func() {
+		ReqResp = MyRecording{}
+		recorder(RequestRecording{Verb: "POST",
+			Uri: "https://h/api/oauth2?grant_type=refresh_token&refresh_token=secret"})
+		recorder(RequestRecording{Verb: "GET", Uri: "https://h/api/clouds"})
+		Ω(ReqResp.Interactions).Should(HaveLen(2))
+		Ω(ReqResp.Interactions[0].Uri).Should(Equal(
+			"https://h/api/oauth2?grant_type=refresh_token&refresh_token=REDACTED"))
+	})
+
+	It("keeps the mode of the cassette file when rewriting it", func() {
+		dir, _ := ioutil.TempDir("", "cassette")
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "recording.json")
+		Ω(ioutil.WriteFile(filename, nil, 0644)).Should(Succeed())
+		recs := []MyRecording{{CmdArgs: []string{"index", "clouds"}}}
+		Ω(writeCassette(filename, recs)).Should(Succeed())
+		fi, err := os.Stat(filename)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fi.Mode().Perm()).Should(Equal(os.FileMode(0644)))
+		Ω(readCassette(filename)).Should(Equal(recs))
+	})
+
+})
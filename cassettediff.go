@@ -0,0 +1,297 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Cassette diff
+
+// rs-api cassette diff old.json new.json reports how the recordings of two cassettes differ,
+// typically after re-recording the test fixtures or updating them (see recording_test.go).
+// Recordings are paired by command line, repeated commands in order, and for each pair the
+// exit code, the output, and the interactions are compared. Interactions are paired in order
+// and compared like replay matches requests (see requestmatch.go): verb, path, query, and body
+// of the request, then status, headers, and body of the response. For json bodies the paths of
+// the values that differ are listed. Output example:
+//   ~ --xm .name show /api/clouds/6
+//       exit code 0 -> 1
+//       interaction 1 GET /api/clouds/6: status 200 -> 404
+//   + index deployments
+//   - index clouds
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+// response headers that change with every request
+var volatileHeaders = map[string]bool{"Date": true, "Content-Length": true}
+
+// cassetteCmd implements the cassette subcommand
+func cassetteCmd(args []string) {
+	cmd := kingpin.New("rs-api cassette", `Work with cassettes recorded using --record`)
+	diff := cmd.Command("diff", "report the differences between the recordings of two cassettes")
+	oldFile := diff.Arg("old", "old cassette file").Required().String()
+	newFile := diff.Arg("new", "new cassette file").Required().String()
+	_ = kingpin.MustParse(cmd.Parse(args))
+
+	oldRecs, err := readCassette(*oldFile)
+	kingpin.FatalIfError(err, "")
+	newRecs, err := readCassette(*newFile)
+	kingpin.FatalIfError(err, "")
+	if diffCassettes(os.Stdout, oldRecs, newRecs) {
+		osExit(1)
+	}
+}
+
+// diffCassettes prints the differences between the recordings, it returns whether there are
+// any
+func diffCassettes(w io.Writer, oldRecs, newRecs []MyRecording) bool {
+	used := make([]bool, len(oldRecs))
+	changed := false
+	for _, n := range newRecs {
+		cmd := strings.Join(n.CmdArgs, " ")
+		found := -1
+		for i, o := range oldRecs {
+			if !used[i] && strings.Join(o.CmdArgs, " ") == cmd {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			fmt.Fprintf(w, "+ %s\n", cmd)
+			changed = true
+			continue
+		}
+		used[found] = true
+		if diffs := diffRecording(oldRecs[found], n); len(diffs) > 0 {
+			fmt.Fprintf(w, "~ %s\n", cmd)
+			for _, d := range diffs {
+				fmt.Fprintf(w, "    %s\n", d)
+			}
+			changed = true
+		}
+	}
+	for i, o := range oldRecs {
+		if !used[i] {
+			fmt.Fprintf(w, "- %s\n", strings.Join(o.CmdArgs, " "))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// diffRecording describes the differences between two recordings of the same command
+func diffRecording(o, n MyRecording) []string {
+	var diffs []string
+	if o.ExitCode != n.ExitCode {
+		diffs = append(diffs, fmt.Sprintf("exit code %d -> %d", o.ExitCode, n.ExitCode))
+	}
+	if o.Stdout != n.Stdout {
+		diffs = append(diffs, "stdout "+diffText(o.Stdout, n.Stdout))
+	}
+	for i := 0; i < len(o.Interactions) || i < len(n.Interactions); i++ {
+		switch {
+		case i >= len(n.Interactions):
+			diffs = append(diffs, fmt.Sprintf("interaction %d %s: removed", i+1,
+				describeInteraction(o.Interactions[i])))
+		case i >= len(o.Interactions):
+			diffs = append(diffs, fmt.Sprintf("interaction %d %s: added", i+1,
+				describeInteraction(n.Interactions[i])))
+		default:
+			for _, d := range diffInteraction(o.Interactions[i], n.Interactions[i]) {
+				diffs = append(diffs, fmt.Sprintf("interaction %d %s: %s", i+1,
+					describeInteraction(n.Interactions[i]), d))
+			}
+		}
+	}
+	return diffs
+}
+
+// describeInteraction returns the verb and path of the request
+func describeInteraction(rr RequestRecording) string {
+	if u, err := url.Parse(rr.Uri); err == nil {
+		return rr.Verb + " " + u.Path
+	}
+	return rr.Verb + " " + rr.Uri
+}
+
+// diffInteraction describes the differences between two interactions
+func diffInteraction(o, n RequestRecording) []string {
+	var diffs []string
+	oURI, nURI := o.Uri, n.Uri
+	if ou, err := url.Parse(o.Uri); err == nil {
+		oURI = ou.Path + "?" + normalizeQuery(ou.RawQuery)
+	}
+	if nu, err := url.Parse(n.Uri); err == nil {
+		nURI = nu.Path + "?" + normalizeQuery(nu.RawQuery)
+	}
+	if o.Verb != n.Verb || oURI != nURI {
+		diffs = append(diffs, fmt.Sprintf("request %s %s -> %s %s", o.Verb,
+			strings.TrimSuffix(oURI, "?"), n.Verb, strings.TrimSuffix(nURI, "?")))
+	}
+	diffs = append(diffs, diffHeaders("request header", o.ReqHeader, n.ReqHeader)...)
+	if d := diffBody(o.ReqHeader.Get("Content-Type"), o.ReqBody, n.ReqBody); d != "" {
+		diffs = append(diffs, "request body "+d)
+	}
+	if o.Status != n.Status {
+		diffs = append(diffs, fmt.Sprintf("status %d -> %d", o.Status, n.Status))
+	}
+	diffs = append(diffs, diffHeaders("header", o.RespHeader, n.RespHeader)...)
+	if d := diffBody(o.RespHeader.Get("Content-Type"), o.RespBody, n.RespBody); d != "" {
+		diffs = append(diffs, "response body "+d)
+	}
+	return diffs
+}
+
+// diffHeaders describes the headers that were added, removed, or changed, what is how they're
+// referred to, e.g. "request header"
+func diffHeaders(what string, o, n http.Header) []string {
+	names := map[string]bool{}
+	for k := range o {
+		names[http.CanonicalHeaderKey(k)] = true
+	}
+	for k := range n {
+		names[http.CanonicalHeaderKey(k)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		if !volatileHeaders[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	var diffs []string
+	for _, k := range sorted {
+		ov, nv := strings.Join(o[k], ", "), strings.Join(n[k], ", ")
+		switch {
+		case o[k] == nil:
+			diffs = append(diffs, fmt.Sprintf("%s %s added: %s", what, k, nv))
+		case n[k] == nil:
+			diffs = append(diffs, fmt.Sprintf("%s %s removed", what, k))
+		case ov != nv:
+			diffs = append(diffs, fmt.Sprintf("%s %s %s -> %s", what, k, ov, nv))
+		}
+	}
+	return diffs
+}
+
+// diffBody describes how a body changed, "" if it didn't
+func diffBody(contentType, o, n string) string {
+	if bodiesMatch(contentType, o, n) {
+		return ""
+	}
+	oData, err1 := decodeOrdered([]byte(o))
+	nData, err2 := decodeOrdered([]byte(n))
+	if err1 != nil || err2 != nil || strings.TrimSpace(o) == "" || strings.TrimSpace(n) == "" {
+		return diffText(o, n)
+	}
+	paths := diffJSON("", oData, nData, nil)
+	if len(paths) > maxExplained {
+		paths = append(paths[:maxExplained], fmt.Sprintf("and %d more",
+			len(paths)-maxExplained))
+	}
+	return "changed at " + strings.Join(paths, ", ")
+}
+
+// diffJSON appends the json pointers of the values that differ between two documents
+func diffJSON(path string, o, n interface{}, paths []string) []string {
+	switch ot := o.(type) {
+	case object:
+		nt, ok := n.(object)
+		if !ok {
+			break
+		}
+		seen := map[string]bool{}
+		for _, f := range ot {
+			seen[f.key] = true
+			p := path + "/" + pointerToken(f.key)
+			if nv, ok := nt.get(f.key); ok {
+				paths = diffJSON(p, f.value, nv, paths)
+			} else {
+				paths = append(paths, p+" (removed)")
+			}
+		}
+		for _, f := range nt {
+			if !seen[f.key] {
+				paths = append(paths, path+"/"+pointerToken(f.key)+" (added)")
+			}
+		}
+		return paths
+	case []interface{}:
+		nt, ok := n.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(ot) || i < len(nt); i++ {
+			p := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(nt):
+				paths = append(paths, p+" (removed)")
+			case i >= len(ot):
+				paths = append(paths, p+" (added)")
+			default:
+				paths = diffJSON(p, ot[i], nt[i], paths)
+			}
+		}
+		return paths
+	}
+	if canonical(o) != canonical(n) {
+		if path == "" {
+			path = "/" // the empty pointer would be hard to read
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// max number of characters shown around the first difference by diffText
+const maxShown = 60
+
+// diffText shows the line where two texts first differ, long lines are cut around the first
+// differing character
+func diffText(o, n string) string {
+	ol, nl := strings.SplitAfter(o, "\n"), strings.SplitAfter(n, "\n")
+	line := 0
+	for line < len(ol)-1 && line < len(nl)-1 && ol[line] == nl[line] {
+		line++
+	}
+	or, nr := []rune(ol[line]), []rune(nl[line])
+	at := 0
+	for at < len(or) && at < len(nr) && or[at] == nr[at] {
+		at++
+	}
+	res := fmt.Sprintf("%s -> %s", excerpt(or, at), excerpt(nr, at))
+	if len(ol) > 1 || len(nl) > 1 {
+		res = fmt.Sprintf("line %d: %s", line+1, res)
+	}
+	return res
+}
+
+// excerpt quotes the part of the text around position at
+func excerpt(r []rune, at int) string {
+	start, end := 0, len(r)
+	if end-start > maxShown {
+		start = at - maxShown/3
+		if start < 0 {
+			start = 0
+		}
+		if end > start+maxShown {
+			end = start + maxShown
+		}
+	}
+	s := strconv.Quote(string(r[start:end]))
+	if start > 0 {
+		s = "..." + s
+	}
+	if end < len(r) {
+		s += "..."
+	}
+	return s
+}
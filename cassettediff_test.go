@@ -0,0 +1,75 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cassette diff", func() {
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}, "Date": {"today"}}
+	show := RequestRecording{Verb: "GET", Uri: "https://h/api/clouds/6?a=1&b=2", Status: 200,
+		RespHeader: jsonHeader, RespBody: `{"name":"EC2","links":[{"rel":"self"}]}`}
+
+	It("reports nothing for equivalent cassettes", func() {
+		other := show
+		other.Uri = "https://other/api/clouds/6?b=2&a=1"
+		other.RespHeader = http.Header{"Content-Type": {"application/json"}, "Date": {"later"}}
+		other.RespBody = `{"links":[{"rel":"self"}], "name":"EC2"}`
+		var buf bytes.Buffer
+		Ω(diffCassettes(&buf,
+			[]MyRecording{{CmdArgs: []string{"show", "x"}, Interactions: []RequestRecording{show}}},
+			[]MyRecording{{CmdArgs: []string{"show", "x"}, Interactions: []RequestRecording{other}}},
+		)).Should(BeFalse())
+		Ω(buf.String()).Should(BeEmpty())
+	})
+
+	It("reports added, removed, and changed recordings", func() {
+		changed := show
+		changed.Status = 404
+		changed.RespHeader = http.Header{"Content-Type": {"text/plain"}}
+		changed.RespBody = `{"name":"EC2 us-west-2","links":[]}`
+		var buf bytes.Buffer
+		Ω(diffCassettes(&buf,
+			[]MyRecording{
+				{CmdArgs: []string{"index", "clouds"}},
+				{CmdArgs: []string{"show", "x"}, Stdout: "EC2",
+					Interactions: []RequestRecording{show, show}},
+			},
+			[]MyRecording{
+				{CmdArgs: []string{"show", "x"}, ExitCode: 4, Stdout: "",
+					Interactions: []RequestRecording{changed}},
+				{CmdArgs: []string{"index", "deployments"}},
+			},
+		)).Should(BeTrue())
+		Ω(buf.String()).Should(Equal(`~ show x
+    exit code 0 -> 4
+    stdout "EC2" -> ""
+    interaction 1 GET /api/clouds/6: status 200 -> 404
+    interaction 1 GET /api/clouds/6: header Content-Type application/json -> text/plain
+    interaction 1 GET /api/clouds/6: response body changed at /name, /links/0 (removed)
+    interaction 2 GET /api/clouds/6: removed
++ index deployments
+- index clouds
+`))
+	})
+
+	It("reports request changes", func() {
+		other := show
+		other.Verb, other.Uri, other.ReqBody = "POST", "https://h/api/clouds/6?a=2", "x=1"
+		other.ReqHeader = http.Header{"X-Api-Version": {"1.6"}}
+		show := show
+		show.ReqHeader = http.Header{"X-Api-Version": {"1.5"}}
+		Ω(diffInteraction(show, other)).Should(Equal([]string{
+			"request GET /api/clouds/6?a=1&b=2 -> POST /api/clouds/6?a=2",
+			"request header X-Api-Version 1.5 -> 1.6",
+			`request body "" -> "x=1"`,
+		}))
+		Ω(diffText("a\nb\n", "a\nc\n")).Should(Equal(`line 2: "b\n" -> "c\n"`))
+	})
+})
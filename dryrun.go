@@ -0,0 +1,101 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Dry runs
+
+// --dry-run prints the request rs-api would send instead of sending it, i.e., after resolving
+// resource shortcuts such as "clouds", the verb and URI of the action (see resolveRequest), and
+// the escaping of the arguments: the method and full URL on the first line, the headers, and
+// the body if there is one, much like the request appears on the wire. --curl prints an
+// equivalent curl command instead. Secrets are redacted in both, see redact.go, so the
+// credentials have to be filled in to run the curl command. The one thing a dry run needs the
+// API for is resolving "self", which reads the instance's href from RL10 or the API but doesn't
+// store it in RL10 as usual, see getSelfHref.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+// dryRun prints the request that would be performed, or the equivalent curl command
+func dryRun(ctx context.Context, method, uri string, args []string) {
+	req, err := rightscale().NewRequest(ctx, method, uri, args, "", "")
+	kingpin.FatalIfError(err, "")
+	if *curlFlag {
+		fmt.Fprintln(osStdout, curlCommand(req, redaction))
+	} else {
+		fmt.Fprint(osStdout, describeRequest(req, redaction))
+	}
+}
+
+// describeRequest shows the method and URL, the headers sorted by name, and the body of a
+// request with its secrets redacted
+func describeRequest(req *http.Request, redact *redactor) string {
+	s := req.Method + " " + redact.uri(req.URL.String()) + "\n"
+	h := redact.header(req.Header)
+	for _, k := range headerNames(h) {
+		for _, v := range h[k] {
+			s += k + ": " + v + "\n"
+		}
+	}
+	if body := requestBody(req); body != "" {
+		s += "\n" + redact.body(req.Header.Get("Content-Type"), body) + "\n"
+	}
+	return s
+}
+
+// curlCommand returns a curl command line that performs the request, with its secrets
+// redacted
+func curlCommand(req *http.Request, redact *redactor) string {
+	cmd := []string{"curl"}
+	if req.Method != "GET" {
+		cmd = append(cmd, "-X", req.Method)
+	}
+	u := redact.uri(req.URL.String())
+	if strings.ContainsAny(u, "[]{}") {
+		cmd = append(cmd, "-g") // args such as filter[] aren't url globs
+	}
+	cmd = append(cmd, shellQuote(u))
+	h := redact.header(req.Header)
+	for _, k := range headerNames(h) {
+		for _, v := range h[k] {
+			cmd = append(cmd, "-H", shellQuote(k+": "+v))
+		}
+	}
+	if body := requestBody(req); body != "" {
+		body = redact.body(req.Header.Get("Content-Type"), body)
+		cmd = append(cmd, "--data-binary", shellQuote(body))
+	}
+	return strings.Join(cmd, " ")
+}
+
+// headerNames returns the names of the headers sorted
+func headerNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestBody returns a copy of the body of a request made by the client
+func requestBody(req *http.Request) string {
+	if req.GetBody == nil {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	b, _ := ioutil.ReadAll(body)
+	return string(b)
+}
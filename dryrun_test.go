@@ -0,0 +1,79 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Dry runs", func() {
+
+	It("resolves actions and escapes arguments", func() {
+		parseFlags()
+		method, uri, args := resolveRequest("/api/clouds", "index",
+			[]string{"filter[]=name==EC2 us"})
+		Ω([]interface{}{method, uri, args}).Should(Equal([]interface{}{
+			"GET", "/api/clouds", []string{"filter[]=name%3D%3DEC2+us"}}))
+		method, uri, _ = resolveRequest("/api/servers/1", "launch", nil)
+		Ω(method + " " + uri).Should(Equal("POST /api/servers/1/launch"))
+		method, uri, _ = resolveRequest("/api/server_templates/2", "show_source", nil)
+		Ω(method + " " + uri).Should(Equal("GET /api/server_templates/2/source"))
+		method, uri, _ = resolveRequest("/api/deployments/3", "destroy", nil)
+		Ω(method + " " + uri).Should(Equal("DELETE /api/deployments/3"))
+
+		parseFlags("--accept", "xml")
+		_, uri, _ = resolveRequest("/api/clouds", "index", nil)
+		Ω(uri).Should(Equal("/api/clouds.xml"))
+		_, uri, _ = resolveRequest("/rll/env", "index", nil)
+		Ω(uri).Should(Equal("/rll/env"))
+	})
+
+	It("prints the request and the curl command with secrets redacted", func() {
+		c := &client{httpServer: "https://h", apiVersion: "1.5", apiKey: "my-key"}
+		req, err := c.NewRequest(context.Background(), "POST", "/api/servers/1/launch",
+			[]string{"inputs[FOO]=text%3Ait%27s"}, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(describeRequest(req, nil)).Should(Equal(
+			"POST https://h/api/servers/1/launch?inputs[FOO]=text%3Ait%27s\n" +
+				"Authorization: REDACTED\nUser-Agent: right_api_cmd\nX-Api-Version: 1.5\n"))
+		Ω(curlCommand(req, nil)).Should(Equal(`curl -X POST -g ` +
+			`'https://h/api/servers/1/launch?inputs[FOO]=text%3Ait%27s' ` +
+			`-H 'Authorization: REDACTED' -H 'User-Agent: right_api_cmd' ` +
+			`-H 'X-Api-Version: 1.5'`))
+
+		c = &client{httpServer: "http://localhost:1", apiVersion: "1.5", proxySecret: "s"}
+		req, err = c.NewRequest(context.Background(), "PUT", "/rll/env/X", nil,
+			"application/json", `{"password":"p","x":"it's"}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(describeRequest(req, nil)).Should(HaveSuffix(
+			"X-Rll-Secret: REDACTED\n\n" + `{"password":"REDACTED","x":"it's"}` + "\n"))
+		Ω(curlCommand(req, nil)).Should(HaveSuffix(
+			`--data-binary '{"password":"REDACTED","x":"it'\''s"}'`))
+	})
+
+	It("looks up self without storing it in RL10", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		jsonHeader := http.Header{"Content-Type": {"application/json"}}
+		server.AppendHandlers(
+			ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/rll/env"),
+				ghttp.RespondWith(200, `{}`, jsonHeader)),
+			ghttp.CombineHandlers(ghttp.VerifyRequest("GET", "/api/session/instance"),
+				ghttp.RespondWith(200,
+					`{"links":[{"rel":"self","href":"/api/clouds/1/instances/2"}]}`,
+					jsonHeader)),
+		)
+		parseFlags("--rl10", "--dry-run")
+		rsClientInternal, _ = NewProxyClient(strings.TrimPrefix(server.URL(), "http://"),
+			"secret", false)
+		defer func() { rsClientInternal = nil }()
+		Ω(getSelfHref(context.Background())).Should(Equal("/api/clouds/1/instances/2"))
+		Ω(server.ReceivedRequests()).Should(HaveLen(2)) // no PUT /rll/env/RS_SELF_HREF
+	})
+})
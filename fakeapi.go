@@ -0,0 +1,733 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Stateful fake API server
+
+// rs-api fake-server runs an in-memory stand-in for the RightScale API that, unlike
+// mock-server, keeps state so flows such as create-show-destroy work. It implements a core
+// set of resources:
+// - clouds, with their images and instance_types (seeded, read-only)
+// - server_templates (seeded, read-only)
+// - deployments: index, show, create, update, destroy
+// - servers: index, show, create, update, destroy, launch, terminate
+// - instances (in /api/clouds/:id/instances): index, show, create, update, terminate
+// - tags: multi_add, multi_delete, by_resource, by_tag
+// Resources have links like the real API, create responds with a Location header, and index
+// supports filter[]=field==value and filter[]=field<>value where strings match partially and
+// fields named like xxx_href match the href of the xxx link. Instances go through states in a
+// deterministic fashion: each time an instance is shown it advances one step from pending to
+// booting to operational, respectively from decommissioning to terminated after a terminate.
+// A server's state is the state of its current instance, inactive if it has none. Parameters
+// are accepted in the query string, as a form, or as json. Credentials are not checked and
+// /api/oauth2 always hands out a made-up access token.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+// fakeServerCmd implements the fake-server subcommand
+func fakeServerCmd(args []string) {
+	cmd := kingpin.New("rs-api fake-server", `Run a stateful in-memory fake of the RightScale API
+
+rs-api fake-server implements a small subset of the RightScale API 1.5 (clouds, images,
+instance_types, server_templates, deployments, servers, instances, and tags) in memory, so
+scripts that create and destroy resources can be tested locally, for example in CI.
+`)
+	listen := cmd.Flag("listen", "address to listen on, ex: :8080 or localhost:8080").
+		Default(":8080").String()
+	_ = kingpin.MustParse(cmd.Parse(args))
+
+	fmt.Fprintf(os.Stderr, "rs-api fake-server: listening on %s\n", *listen)
+	err := http.ListenAndServe(*listen, newFakeAPI(os.Stderr))
+	kingpin.FatalIfError(err, "")
+}
+
+// fakeKinds maps the name of collections to the kind of resources they hold
+var fakeKinds = map[string]string{
+	"clouds": "cloud", "images": "image", "instance_types": "instance_type",
+	"server_templates": "server_template", "deployments": "deployment", "servers": "server",
+	"instances": "instance",
+}
+
+// state an instance moves to when it is shown
+var fakeNextState = map[string]string{
+	"pending": "booting", "booting": "operational", "decommissioning": "terminated",
+}
+
+// fakeResource is a resource of the fake API
+type fakeResource struct {
+	kind   string
+	href   string
+	fields object      // json fields in the order they're rendered, excluding links
+	links  [][2]string // rel and href
+}
+
+// link returns the href of the named link or ""
+func (r *fakeResource) link(rel string) string {
+	for _, l := range r.links {
+		if l[0] == rel {
+			return l[1]
+		}
+	}
+	return ""
+}
+
+// setLink adds, replaces, or with an empty href removes a link
+func (r *fakeResource) setLink(rel, href string) {
+	for i, l := range r.links {
+		if l[0] == rel {
+			if href == "" {
+				r.links = append(r.links[:i], r.links[i+1:]...)
+			} else {
+				r.links[i][1] = href
+			}
+			return
+		}
+	}
+	if href != "" {
+		r.links = append(r.links, [2]string{rel, href})
+	}
+}
+
+// set sets a field, appending it if it doesn't exist yet
+func (r *fakeResource) set(key string, value interface{}) {
+	for i, f := range r.fields {
+		if f.key == key {
+			r.fields[i].value = value
+			return
+		}
+	}
+	r.fields = append(r.fields, field{key, value})
+}
+
+// str returns a string field or ""
+func (r *fakeResource) str(key string) string {
+	v, _ := r.fields.get(key)
+	s, _ := v.(string)
+	return s
+}
+
+// render produces the json object for the resource
+func (r *fakeResource) render() object {
+	links := make([]interface{}, len(r.links))
+	for i, l := range r.links {
+		links[i] = object{{"rel", l[0]}, {"href", l[1]}}
+	}
+	return append(append(object{}, r.fields...), field{"links", links})
+}
+
+// fakeError is an API error with its http status
+type fakeError struct {
+	status int
+	msg    string
+}
+
+func (e *fakeError) Error() string { return e.msg }
+
+func fakeErrorf(status int, format string, args ...interface{}) *fakeError {
+	return &fakeError{status, fmt.Sprintf(format, args...)}
+}
+
+// fakeAPI is the state of the fake API and its http.Handler
+type fakeAPI struct {
+	sync.Mutex
+	lastID    int
+	resources map[string]*fakeResource // by href
+	members   map[string][]string      // hrefs of the resources in each collection, in order
+	tags      map[string][]string      // tags of each resource href
+	now       func() time.Time
+	log       io.Writer // where each request is logged
+}
+
+// newFakeAPI creates a fake API seeded with clouds, images, instance types, and server
+// templates
+func newFakeAPI(log io.Writer) *fakeAPI {
+	f := &fakeAPI{resources: map[string]*fakeResource{}, members: map[string][]string{},
+		tags: map[string][]string{}, now: time.Now, log: log}
+	for _, c := range []string{"/api/clouds", "/api/server_templates", "/api/deployments",
+		"/api/servers"} {
+		f.members[c] = []string{}
+	}
+	for _, c := range [][3]string{
+		{"1", "EC2 us-east-1", "amazon"},
+		{"2", "EC2 eu-west-1", "amazon"},
+		{"6", "EC2 us-west-2", "amazon"},
+		{"2178", "Azure East US", "azure"},
+	} {
+		cloud := f.add("/api/clouds", c[0], object{
+			{"name", c[1]}, {"description", c[1]}, {"display_name", c[1]},
+			{"cloud_type", c[2]}})
+		for _, sub := range []string{"images", "instance_types", "instances"} {
+			f.members[cloud.href+"/"+sub] = []string{}
+			cloud.setLink(sub, cloud.href+"/"+sub)
+		}
+		f.add(cloud.href+"/images", "", object{
+			{"name", "RightImage_Ubuntu_14.04_x64"}, {"resource_uid", "ami-6089d208"},
+			{"os_platform", "linux"}, {"cpu_architecture", "x86_64"}})
+		for _, t := range []string{"m3.medium", "m3.large"} {
+			f.add(cloud.href+"/instance_types", "", object{
+				{"name", t}, {"resource_uid", t}, {"description", t}})
+		}
+	}
+	f.add("/api/server_templates", "", object{
+		{"name", "Rightlink 10.0.rc4 Linux Base"}, {"revision", json.Number("0")},
+		{"description", "RightLink10 base server template"}})
+	return f
+}
+
+// add creates a resource in the collection, generating an id if none is given
+func (f *fakeAPI) add(coll, id string, fields object) *fakeResource {
+	f.lastID++
+	if id == "" {
+		id = strconv.Itoa(f.lastID)
+		if fakeKinds[coll[strings.LastIndex(coll, "/")+1:]] == "instance" {
+			// instance ids are alphanumeric
+			id = strings.ToUpper(strconv.FormatInt(int64(f.lastID)*7919, 36))
+		}
+	}
+	r := &fakeResource{kind: fakeKinds[coll[strings.LastIndex(coll, "/")+1:]],
+		href: coll + "/" + id, fields: fields}
+	r.setLink("self", r.href)
+	if r.kind == "deployment" || r.kind == "server" || r.kind == "instance" {
+		ts := f.now().Format(apiTimeFormats[0])
+		r.set("created_at", ts)
+		r.set("updated_at", ts)
+	}
+	f.resources[r.href] = r
+	f.members[coll] = append(f.members[coll], r.href)
+	return r
+}
+
+// remove deletes a resource from its collection
+func (f *fakeAPI) remove(r *fakeResource) {
+	coll := r.href[:strings.LastIndex(r.href, "/")]
+	m := f.members[coll]
+	for i, h := range m {
+		if h == r.href {
+			f.members[coll] = append(m[:i:i], m[i+1:]...)
+			break
+		}
+	}
+	delete(f.resources, r.href)
+	delete(f.tags, r.href)
+}
+
+// fakeRoute splits a path into the collection, the resource href, and the action, e.g.
+// /api/clouds/1/instances/AB/terminate produces /api/clouds/1/instances,
+// /api/clouds/1/instances/AB, and terminate
+func fakeRoute(path string) (coll, href, action string, ok bool) {
+	if !strings.HasPrefix(path, "/api/") {
+		return "", "", "", false
+	}
+	segs := strings.Split(strings.TrimPrefix(path, "/api/"), "/")
+	coll, segs = "/api/"+segs[0], segs[1:]
+	for {
+		switch {
+		case len(segs) == 0:
+			return coll, href, "", true
+		case href != "" && fakeKinds[segs[0]] != "":
+			coll, href, segs = href+"/"+segs[0], "", segs[1:]
+		case href != "" && len(segs) == 1:
+			return coll, href, segs[0], true
+		case href != "":
+			return "", "", "", false
+		default:
+			href, segs = coll+"/"+segs[0], segs[1:]
+		}
+	}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	status, header, body, err := f.serve(req)
+	if err != nil {
+		status = err.status
+		header = http.Header{"Content-Type": {"text/plain"}}
+		body = []byte(err.msg)
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+	fmt.Fprintf(f.log, "%s %s: %d\n", req.Method, req.URL.RequestURI(), status)
+}
+
+// serve performs the request and returns the response
+func (f *fakeAPI) serve(req *http.Request) (int, http.Header, []byte, *fakeError) {
+	params, err := fakeParams(req)
+	if err != nil {
+		return 0, nil, nil, fakeErrorf(400, "BadRequest: %s", err.Error())
+	}
+	if req.URL.Path == "/api/oauth2" && req.Method == "POST" {
+		return 200, http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+			[]byte(mockOAuthResponse), nil
+	}
+	if strings.HasPrefix(req.URL.Path, "/api/tags/") {
+		return f.tagAction(strings.TrimPrefix(req.URL.Path, "/api/tags/"), params)
+	}
+
+	coll, href, action, ok := fakeRoute(req.URL.Path)
+	if _, exists := f.members[coll]; !ok || !exists {
+		return 0, nil, nil, fakeErrorf(404, "NotFound: no route matches %s %s",
+			req.Method, req.URL.Path)
+	}
+	kind := fakeKinds[coll[strings.LastIndex(coll, "/")+1:]]
+
+	if href == "" {
+		switch req.Method {
+		case "GET":
+			return f.index(coll, kind, params)
+		case "POST":
+			return f.create(coll, kind, params)
+		}
+		return 0, nil, nil, fakeErrorf(405, "MethodNotAllowed: %s %s", req.Method, coll)
+	}
+
+	r := f.resources[href]
+	if r == nil {
+		return 0, nil, nil, fakeErrorf(404, "ResourceNotFound: Couldn't find %s with ID=%s",
+			kind, href[strings.LastIndex(href, "/")+1:])
+	}
+	switch {
+	case action != "" && req.Method == "POST":
+		return f.action(r, action)
+	case action != "":
+		return 0, nil, nil, fakeErrorf(404, "NotFound: no route matches %s %s",
+			req.Method, req.URL.Path)
+	case req.Method == "GET":
+		if r.kind == "instance" {
+			if next := fakeNextState[r.str("state")]; next != "" {
+				r.set("state", next)
+			}
+		}
+		return f.respond(200, r.kind, false, f.render(r))
+	case (req.Method == "PUT" || req.Method == "POST") && f.creatable(kind):
+		return f.update(r, params)
+	case req.Method == "DELETE" && (kind == "deployment" || kind == "server"):
+		return f.destroy(r)
+	}
+	return 0, nil, nil, fakeErrorf(405, "MethodNotAllowed: %s %s", req.Method, href)
+}
+
+// creatable returns whether resources of the kind can be created and updated
+func (f *fakeAPI) creatable(kind string) bool {
+	return kind == "deployment" || kind == "server" || kind == "instance"
+}
+
+// render renders a resource with its current state, a server loses its current instance once
+// that is terminated
+func (f *fakeAPI) render(r *fakeResource) object {
+	if r.kind == "server" {
+		r.set("state", f.serverState(r))
+		if r.str("state") == "inactive" {
+			r.setLink("current_instance", "")
+		}
+	}
+	return r.render()
+}
+
+// serverState returns the state of the current instance of the server or inactive
+func (f *fakeAPI) serverState(r *fakeResource) string {
+	inst := f.resources[r.link("current_instance")]
+	if inst == nil || inst.str("state") == "terminated" {
+		return "inactive"
+	}
+	return inst.str("state")
+}
+
+// respond produces a json response for a resource or a collection
+func (f *fakeAPI) respond(status int, kind string, collection bool, v interface{}) (
+	int, http.Header, []byte, *fakeError) {
+
+	ct := "application/vnd.rightscale." + kind + "+json"
+	if collection {
+		ct += ";type=collection"
+	}
+	return status, http.Header{"Content-Type": {ct + ";charset=utf-8"}},
+		[]byte(compactJSON(v)), nil
+}
+
+// index lists the resources of a collection that pass all filters
+func (f *fakeAPI) index(coll, kind string, params url.Values) (
+	int, http.Header, []byte, *fakeError) {
+
+	res := []interface{}{}
+	for _, href := range f.members[coll] {
+		r := f.resources[href]
+		ok, err := fakeFilter(r, params["filter[]"])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if ok {
+			res = append(res, f.render(r))
+		}
+	}
+	return f.respond(200, kind, true, res)
+}
+
+var reFakeFilter = regexp.MustCompile(`^([a-z_]+)(==|<>)(.*)$`)
+
+// fakeFilter returns whether the resource passes all filters
+func fakeFilter(r *fakeResource, filters []string) (bool, *fakeError) {
+	for _, flt := range filters {
+		m := reFakeFilter.FindStringSubmatch(flt)
+		if m == nil {
+			return false, fakeErrorf(422, "InvalidFilter: cannot parse filter '%s'", flt)
+		}
+		var match bool
+		if strings.HasSuffix(m[1], "_href") {
+			match = r.link(strings.TrimSuffix(m[1], "_href")) == m[3]
+		} else {
+			v, ok := r.fields.get(m[1])
+			if !ok {
+				return false, fakeErrorf(422, "InvalidFilter: %s cannot be filtered by %s",
+					r.kind, m[1])
+			}
+			match = strings.Contains(fmt.Sprint(v), m[3])
+		}
+		if match != (m[2] == "==") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// required returns the named parameters of the kind, e.g. deployment[name], failing if one
+// of them is missing
+func required(kind string, params url.Values, names ...string) ([]string, *fakeError) {
+	vals := make([]string, len(names))
+	for i, n := range names {
+		k := kind + "[" + strings.Replace(n, ".", "][", -1) + "]"
+		vals[i] = params.Get(k)
+		if vals[i] == "" {
+			return nil, fakeErrorf(422, "Missing required parameter %s", k)
+		}
+	}
+	return vals, nil
+}
+
+// lookup returns the resource with the href, which must be of the kind
+func (f *fakeAPI) lookup(kind, href string) (*fakeResource, *fakeError) {
+	r := f.resources[href]
+	if r == nil || r.kind != kind {
+		return nil, fakeErrorf(422, "Invalid %s href %s", kind, href)
+	}
+	return r, nil
+}
+
+// create creates a resource from the parameters and responds with its href in Location
+func (f *fakeAPI) create(coll, kind string, params url.Values) (
+	int, http.Header, []byte, *fakeError) {
+
+	var r *fakeResource
+	switch kind {
+	case "deployment":
+		v, err := required(kind, params, "name")
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		r = f.add(coll, "", object{{"name", v[0]},
+			{"description", params.Get("deployment[description]")}})
+	case "server":
+		v, err := required(kind, params, "name", "deployment_href", "instance.cloud_href",
+			"instance.image_href", "instance.instance_type_href")
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if _, err := f.lookup("deployment", v[1]); err != nil {
+			return 0, nil, nil, err
+		}
+		if err := f.checkInstanceParams(v[2], v[3], v[4]); err != nil {
+			return 0, nil, nil, err
+		}
+		r = f.add(coll, "", object{{"name", v[0]},
+			{"description", params.Get("server[description]")}, {"state", "inactive"}})
+		r.setLink("deployment", v[1])
+		r.setLink("cloud", v[2])
+		r.setLink("image", v[3])
+		r.setLink("instance_type", v[4])
+	case "instance":
+		v, err := required(kind, params, "image_href", "instance_type_href")
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		cloud := coll[:strings.LastIndex(coll, "/")]
+		if err := f.checkInstanceParams(cloud, v[0], v[1]); err != nil {
+			return 0, nil, nil, err
+		}
+		dep := params.Get("instance[deployment_href]")
+		if dep != "" {
+			if _, err := f.lookup("deployment", dep); err != nil {
+				return 0, nil, nil, err
+			}
+		}
+		r = f.launch(cloud, params.Get("instance[name]"), v[0], v[1], dep)
+	default:
+		return 0, nil, nil, fakeErrorf(405, "MethodNotAllowed: cannot create %s", kind)
+	}
+	return 201, http.Header{"Location": {r.href}}, nil, nil
+}
+
+// checkInstanceParams verifies that the image and instance type belong to the cloud
+func (f *fakeAPI) checkInstanceParams(cloud, image, instType string) *fakeError {
+	if _, err := f.lookup("cloud", cloud); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(image, cloud+"/") {
+		return fakeErrorf(422, "Invalid image href %s for cloud %s", image, cloud)
+	}
+	if _, err := f.lookup("image", image); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(instType, cloud+"/") {
+		return fakeErrorf(422, "Invalid instance_type href %s for cloud %s", instType, cloud)
+	}
+	_, err := f.lookup("instance_type", instType)
+	return err
+}
+
+// launch creates a pending instance
+func (f *fakeAPI) launch(cloud, name, image, instType, deployment string) *fakeResource {
+	inst := f.add(cloud+"/instances", "", object{{"name", name}, {"state", "pending"},
+		{"locked", false}, {"public_ip_addresses", []interface{}{}},
+		{"private_ip_addresses", []interface{}{}}})
+	inst.set("resource_uid", "i-"+strings.ToLower(inst.href[strings.LastIndex(inst.href, "/")+1:]))
+	inst.setLink("cloud", cloud)
+	inst.setLink("deployment", deployment)
+	inst.setLink("image", image)
+	inst.setLink("instance_type", instType)
+	return inst
+}
+
+// update updates the fields given in the parameters, e.g. deployment[name]=x, fields ending
+// in _href update the respective link
+func (f *fakeAPI) update(r *fakeResource, params url.Values) (
+	int, http.Header, []byte, *fakeError) {
+
+	prefix := r.kind + "["
+	keys := []string{}
+	for k := range params {
+		if strings.HasPrefix(k, prefix) && strings.HasSuffix(k, "]") &&
+			!strings.Contains(k[len(prefix):], "[") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil, nil, fakeErrorf(422, "Missing required parameter %s", r.kind)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := k[len(prefix) : len(k)-1]
+		switch {
+		case name == "state" || name == "resource_uid":
+			return 0, nil, nil, fakeErrorf(422, "%s cannot be updated", name)
+		case strings.HasSuffix(name, "_href"):
+			rel := strings.TrimSuffix(name, "_href")
+			if _, err := f.lookup(rel, params.Get(k)); err != nil {
+				return 0, nil, nil, err
+			}
+			r.setLink(rel, params.Get(k))
+		default:
+			r.set(name, params.Get(k))
+		}
+	}
+	r.set("updated_at", f.now().Format(apiTimeFormats[0]))
+	return 204, nil, nil, nil
+}
+
+// destroy deletes a deployment without servers or a server that is not running
+func (f *fakeAPI) destroy(r *fakeResource) (int, http.Header, []byte, *fakeError) {
+	switch r.kind {
+	case "deployment":
+		for _, href := range f.members["/api/servers"] {
+			if f.resources[href].link("deployment") == r.href {
+				return 0, nil, nil, fakeErrorf(422,
+					"Cannot destroy deployment %s, it has servers", r.href)
+			}
+		}
+	case "server":
+		if state := f.serverState(r); state != "inactive" {
+			return 0, nil, nil, fakeErrorf(422, "Cannot destroy server %s, it is %s",
+				r.href, state)
+		}
+	}
+	f.remove(r)
+	return 204, nil, nil, nil
+}
+
+// action performs a custom action on a resource
+func (f *fakeAPI) action(r *fakeResource, action string) (int, http.Header, []byte, *fakeError) {
+	switch {
+	case r.kind == "instance" && action == "terminate":
+		if st := r.str("state"); st != "terminated" && st != "decommissioning" {
+			r.set("state", "decommissioning")
+		}
+		return 204, nil, nil, nil
+	case r.kind == "server" && action == "launch":
+		if state := f.serverState(r); state != "inactive" {
+			return 0, nil, nil, fakeErrorf(422, "Cannot launch server %s, it is %s",
+				r.href, state)
+		}
+		inst := f.launch(r.link("cloud"), r.str("name"), r.link("image"),
+			r.link("instance_type"), r.link("deployment"))
+		inst.setLink("parent", r.href)
+		r.setLink("current_instance", inst.href)
+		return 201, http.Header{"Location": {inst.href}}, nil, nil
+	case r.kind == "server" && action == "terminate":
+		if f.serverState(r) == "inactive" {
+			return 0, nil, nil, fakeErrorf(422, "Cannot terminate server %s, it is inactive",
+				r.href)
+		}
+		return f.action(f.resources[r.link("current_instance")], "terminate")
+	}
+	return 0, nil, nil, fakeErrorf(404, "NotFound: %s has no action %s", r.kind, action)
+}
+
+// tagAction performs the actions of the tags resource
+func (f *fakeAPI) tagAction(action string, params url.Values) (
+	int, http.Header, []byte, *fakeError) {
+
+	hrefs, tags := params["resource_hrefs[]"], params["tags[]"]
+	for _, h := range hrefs {
+		if f.resources[h] == nil {
+			return 0, nil, nil, fakeErrorf(422, "Invalid resource href %s", h)
+		}
+	}
+
+	switch action {
+	case "multi_add", "multi_delete":
+		if len(hrefs) == 0 || len(tags) == 0 {
+			return 0, nil, nil, fakeErrorf(422,
+				"Missing required parameters resource_hrefs[] and tags[]")
+		}
+		for _, h := range hrefs {
+			for _, t := range tags {
+				f.tags[h] = removeString(f.tags[h], t)
+				if action == "multi_add" {
+					f.tags[h] = append(f.tags[h], t)
+				}
+			}
+		}
+		return 204, nil, nil, nil
+	case "by_resource":
+		res := []interface{}{}
+		for _, h := range hrefs {
+			res = append(res, fakeTagSet(h, f.tags[h]))
+		}
+		return f.respond(200, "tag", true, res)
+	case "by_tag":
+		kind := params.Get("resource_type")
+		if fakeKinds[kind] == "" || len(tags) == 0 {
+			return 0, nil, nil, fakeErrorf(422,
+				"Missing or invalid parameters resource_type and tags[]")
+		}
+		hrefs := []string{}
+		for h, ts := range f.tags {
+			if f.resources[h].kind != fakeKinds[kind] {
+				continue
+			}
+			n := 0
+			for _, t := range tags {
+				if len(removeString(ts, t)) < len(ts) {
+					n++
+				}
+			}
+			if n == len(tags) || n > 0 && params.Get("match_all") != "true" {
+				hrefs = append(hrefs, h)
+			}
+		}
+		sort.Strings(hrefs)
+		res := []interface{}{}
+		for _, h := range hrefs {
+			res = append(res, fakeTagSet(h, f.tags[h]))
+		}
+		return f.respond(200, "tag", true, res)
+	}
+	return 0, nil, nil, fakeErrorf(404, "NotFound: tags have no action %s", action)
+}
+
+// fakeTagSet renders the tags of a resource like the API does
+func fakeTagSet(href string, tags []string) object {
+	ts := []interface{}{}
+	for _, t := range tags {
+		ts = append(ts, object{{"name", t}})
+	}
+	return object{{"tags", ts},
+		{"links", []interface{}{object{{"rel", "resource"}, {"href", href}}}}}
+}
+
+// removeString returns the list without any occurrence of s
+func removeString(list []string, s string) []string {
+	res := []string{}
+	for _, e := range list {
+		if e != s {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// fakeParams collects the request parameters from the query string and from a form or json
+// body, json objects are flattened the way the API does, e.g. {"deployment":{"name":"x"}}
+// becomes deployment[name]=x
+func fakeParams(req *http.Request) (url.Values, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	params := req.Form
+	mt := strings.SplitN(req.Header.Get("Content-Type"), ";", 2)[0]
+	if req.Body == nil || !strings.HasSuffix(strings.TrimSpace(mt), "json") {
+		return params, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || len(strings.TrimSpace(string(body))) == 0 {
+		return params, err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(body)))
+	dec.UseNumber()
+	var data map[string]interface{}
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	flattenParams(params, "", data)
+	return params, nil
+}
+
+// flattenParams adds the json value to the params using bracket notation
+func flattenParams(params url.Values, prefix string, v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if prefix != "" {
+				k = prefix + "[" + k + "]"
+			}
+			flattenParams(params, k, e)
+		}
+	case []interface{}:
+		for _, e := range t {
+			flattenParams(params, prefix+"[]", e)
+		}
+	case nil:
+		params.Add(prefix, "")
+	default:
+		params.Add(prefix, fmt.Sprint(t))
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fake API server", func() {
+
+	var server *httptest.Server
+	var c Client
+	var log bytes.Buffer
+
+	BeforeEach(func() {
+		log.Reset()
+		server = httptest.NewServer(newFakeAPI(&log))
+		c, _ = NewProxyClient(strings.TrimPrefix(server.URL, "http://"), "secret", false)
+		c.SetRetry(RetryPolicy{})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// do performs a request, API errors are checked using the status code
+	do := func(method, uri string, args ...string) *Response {
+		resp, err := c.Do(context.Background(), method, uri, args, "", "")
+		if resp == nil {
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		return resp
+	}
+
+	It("routes paths to collections, resources, and actions", func() {
+		for path, exp := range map[string][3]string{
+			"/api/deployments":        {"/api/deployments", "", ""},
+			"/api/deployments/1":      {"/api/deployments", "/api/deployments/1", ""},
+			"/api/clouds/1/instances": {"/api/clouds/1/instances", "", ""},
+			"/api/clouds/1/instances/AB/terminate": {"/api/clouds/1/instances",
+				"/api/clouds/1/instances/AB", "terminate"},
+		} {
+			coll, href, action, ok := fakeRoute(path)
+			Ω(ok).Should(BeTrue())
+			Ω([3]string{coll, href, action}).Should(Equal(exp), path)
+		}
+		_, _, _, ok := fakeRoute("/api/clouds/1/foo/bar")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("creates, shows, updates, and destroys deployments", func() {
+		resp := do("POST", "/api/deployments", "deployment[name]=rsc-test")
+		Ω(resp.statusCode).Should(Equal(201))
+		href := resp.header.Get("Location")
+		Ω(href).Should(MatchRegexp(`^/api/deployments/[0-9]+$`))
+
+		resp = do("GET", href)
+		Ω(resp.data).Should(HaveKeyWithValue("name", "rsc-test"))
+		Ω(resp.data).Should(HaveKeyWithValue("links", ContainElement(
+			map[string]interface{}{"rel": "self", "href": href})))
+
+		Ω(do("PUT", href, "deployment[description]=test").statusCode).Should(Equal(204))
+		Ω(do("GET", href).data).Should(HaveKeyWithValue("description", "test"))
+
+		Ω(do("DELETE", href).statusCode).Should(Equal(204))
+		Ω(do("GET", href).statusCode).Should(Equal(404))
+		Ω(log.String()).Should(ContainSubstring("DELETE " + href + ": 204\n"))
+	})
+
+	It("rejects creates with missing parameters", func() {
+		resp := do("POST", "/api/deployments")
+		Ω(resp.statusCode).Should(Equal(422))
+		Ω(string(resp.raw)).Should(Equal("Missing required parameter deployment[name]"))
+	})
+
+	It("filters collections", func() {
+		do("POST", "/api/deployments", "deployment[name]=rsc-test")
+		do("POST", "/api/deployments", "deployment[name]=other")
+		resp := do("GET", "/api/deployments", "filter[]=name==rsc")
+		Ω(resp.data).Should(HaveLen(1))
+		resp = do("GET", "/api/deployments", "filter[]=name<>rsc")
+		Ω(resp.data).Should(ConsistOf(HaveKeyWithValue("name", "other")))
+		resp = do("GET", "/api/clouds", "filter[]=cloud_type==amazon",
+			"filter[]=name==us-east-1")
+		Ω(resp.data).Should(ConsistOf(HaveKeyWithValue("name", "EC2 us-east-1")))
+		Ω(do("GET", "/api/clouds", "filter[]=color==red").statusCode).Should(Equal(422))
+	})
+
+	It("moves instances through their states", func() {
+		resp := do("POST", "/api/clouds/1/instances", "instance[name]=test",
+			"instance[image_href]=/api/clouds/1/images/2",
+			"instance[instance_type_href]=/api/clouds/1/instance_types/3")
+		Ω(resp.statusCode).Should(Equal(201))
+		href := resp.header.Get("Location")
+		Ω(href).Should(HavePrefix("/api/clouds/1/instances/"))
+
+		states := []interface{}{}
+		for i := 0; i < 3; i++ {
+			states = append(states, do("GET", href).data.(map[string]interface{})["state"])
+		}
+		Ω(states).Should(Equal([]interface{}{"booting", "operational", "operational"}))
+
+		Ω(do("POST", href+"/terminate").statusCode).Should(Equal(204))
+		Ω(do("GET", href).data).Should(HaveKeyWithValue("state", "terminated"))
+	})
+
+	It("launches and terminates servers", func() {
+		dep := do("POST", "/api/deployments", "deployment[name]=d").header.Get("Location")
+		resp := do("POST", "/api/servers", "server[name]=s", "server[deployment_href]="+dep,
+			"server[instance][cloud_href]=/api/clouds/1",
+			"server[instance][image_href]=/api/clouds/1/images/2",
+			"server[instance][instance_type_href]=/api/clouds/1/instance_types/3")
+		Ω(resp.statusCode).Should(Equal(201))
+		srv := resp.header.Get("Location")
+		Ω(do("GET", srv).data).Should(HaveKeyWithValue("state", "inactive"))
+		Ω(do("DELETE", dep).statusCode).Should(Equal(422))
+
+		resp = do("POST", srv+"/launch")
+		Ω(resp.statusCode).Should(Equal(201))
+		inst := resp.header.Get("Location")
+		Ω(do("GET", srv).data).Should(HaveKeyWithValue("state", "pending"))
+		do("GET", inst)
+		Ω(do("GET", srv).data).Should(HaveKeyWithValue("state", "booting"))
+
+		Ω(do("POST", srv+"/terminate").statusCode).Should(Equal(204))
+		do("GET", inst)
+		Ω(do("GET", srv).data).Should(HaveKeyWithValue("state", "inactive"))
+		Ω(do("DELETE", srv).statusCode).Should(Equal(204))
+		Ω(do("DELETE", dep).statusCode).Should(Equal(204))
+	})
+
+	It("tags resources", func() {
+		dep := do("POST", "/api/deployments", "deployment[name]=d").header.Get("Location")
+		Ω(do("POST", "/api/tags/multi_add", "resource_hrefs[]="+dep,
+			"tags[]=test:a=1", "tags[]=test:b=2").statusCode).Should(Equal(204))
+		Ω(do("POST", "/api/tags/multi_delete", "resource_hrefs[]="+dep,
+			"tags[]=test:a=1").statusCode).Should(Equal(204))
+
+		resp := do("POST", "/api/tags/by_resource", "resource_hrefs[]="+dep)
+		Ω(compactJSON(resp.data)).Should(Equal(`[{"links":[{"href":"` + dep +
+			`","rel":"resource"}],"tags":[{"name":"test:b=2"}]}]`))
+		resp = do("POST", "/api/tags/by_tag", "resource_type=deployments", "tags[]=test:b=2")
+		Ω(resp.data).Should(HaveLen(1))
+	})
+})
@@ -0,0 +1,414 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== HAR export
+
+// --har writes every HTTP request the client performs to a file in the HTTP Archive 1.2 format
+// (http://www.softwareishard.com/blog/har-12-spec/), which browser devtools can import and
+// display. Each attempt is an entry of its own: authentication, re-authentication after the
+// token expired, and retries all show up, with the time spent connecting, sending, waiting for
+// the response, and receiving it. Secrets are redacted like in recordings, see redact.go. The
+// file is rewritten after each request completes, so it holds everything up to the failure
+// when rs-api exits on an error. A response body that is streamed, such as a download or
+// --jsonl output, is added once it's been read, and only if it's no larger than
+// harMaxContent.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 document, only the fields rs-api has information for are included
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"` // ISO 8601
+	Time            float64     `json:"time"`            // total ms, sum of the timings
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"` // request failed without a response
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"` // base64 for binary bodies
+	Comment  string `json:"comment,omitempty"`  // why the text is missing
+}
+
+// max size of a response body included in the HAR file, larger bodies, such as downloads,
+// only have their size recorded so rs-api doesn't have to hold them in memory
+const harMaxContent = 1 << 20
+
+// timings in ms, -1 for the phases that didn't happen, e.g. connect on a reused connection
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"` // includes ssl
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+//===== Collecting entries
+
+// harFile collects the entries and writes them to the HAR file
+type harFile struct {
+	filename string
+	doc      harDocument
+	failed   bool // writing the file failed, reported once only
+	now      func() time.Time
+}
+
+// newHARFile creates the HAR file, empty at first, so a bad filename is reported before
+// any request is made
+func newHARFile(filename string) (*harFile, error) {
+	h := &harFile{filename: filename, now: time.Now, doc: harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "rs-api", Version: VV},
+		Entries: []*harEntry{},
+	}}}
+	return h, h.write()
+}
+
+// write rewrites the HAR file with all the entries so far
+func (h *harFile) write() error {
+	js, err := json.MarshalIndent(h.doc, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(h.filename, append(js, '\n'), 0644)
+	}
+	return err
+}
+
+// save writes the HAR file, errors are reported but don't stop the command
+func (h *harFile) save() {
+	if err := h.write(); err != nil && !h.failed {
+		h.failed = true
+		fmt.Fprintf(os.Stderr, "Warning: cannot write HAR file: %s\n", err.Error())
+	}
+}
+
+// harCall tracks the timing of one attempt at a request
+type harCall struct {
+	sync.Mutex // the trace hooks may be called from the transport's goroutines
+	har        *harFile
+	redact     *redactor
+	start      time.Time
+	// times of the events reported by httptrace, zero if they didn't happen
+	dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone time.Time
+	gotConn, wroteRequest, firstByte                                time.Time
+}
+
+// start begins tracking an attempt, it returns the request to send, which reports the
+// connection events to the harCall
+func (h *harFile) start(req *http.Request, redact *redactor) (*http.Request, *harCall) {
+	call := &harCall{har: h, redact: redact}
+	event := func(t *time.Time) {
+		call.Lock()
+		if t.IsZero() {
+			*t = h.now()
+		}
+		call.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { event(&call.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { event(&call.dnsDone) },
+		ConnectStart:         func(string, string) { event(&call.connectStart) },
+		ConnectDone:          func(string, string, error) { event(&call.connectDone) },
+		TLSHandshakeStart:    func() { event(&call.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { event(&call.tlsDone) },
+		GotConn:              func(httptrace.GotConnInfo) { event(&call.gotConn) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { event(&call.wroteRequest) },
+		GotFirstResponseByte: func() { event(&call.firstByte) },
+	}
+	call.start = h.now()
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), call
+}
+
+// finish adds the entry for the attempt once the response has been processed, a body left
+// unread for streaming is captured as it's read and the entry is updated when it's closed,
+// the entry is saved right away so it's there even if rs-api exits without closing the body
+func (c *harCall) finish(req *http.Request, body []byte, res *http.Response, resp *Response,
+	err error) {
+
+	entry := &harEntry{
+		StartedDateTime: c.start.Format("2006-01-02T15:04:05.000Z07:00"),
+		Request:         c.request(req, body),
+		Response:        harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}},
+	}
+	if res == nil {
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		c.complete(entry, c.har.now())
+		return
+	}
+	entry.Response = c.response(res)
+	if resp != nil && resp.body != nil {
+		entry.Response.Content.Comment = "body not read"
+		c.complete(entry, c.har.now())
+		resp.body = &harBody{ReadCloser: resp.body, call: c, entry: entry}
+		return
+	}
+	if resp != nil {
+		c.content(entry, resp.raw, len(resp.raw))
+	}
+	c.complete(entry, c.har.now())
+}
+
+// complete computes the timings of an entry whose response was received by done and saves
+// it
+func (c *harCall) complete(entry *harEntry, done time.Time) {
+	c.timings(entry, done)
+	c.har.doc.Log.Entries = append(c.har.doc.Log.Entries, entry)
+	c.har.save()
+}
+
+// timings sets the timings of an entry whose response was received by done
+func (c *harCall) timings(entry *harEntry, done time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	t := harTimings{
+		Blocked: -1,
+		DNS:     harMS(c.dnsStart, c.dnsDone),
+		Connect: harMS(c.connectStart, c.connectDone),
+		SSL:     harMS(c.tlsStart, c.tlsDone),
+	}
+	if t.SSL >= 0 {
+		t.Connect = harMS(c.connectStart, c.tlsDone)
+	}
+	// transports that don't report connection events, such as --replay's, only get a wait
+	sent := c.start
+	if !c.gotConn.IsZero() {
+		// blocked until the connection is being set up or, if one is reused, obtained
+		blockedUntil := c.gotConn
+		for _, e := range []time.Time{c.connectStart, c.dnsStart} {
+			if !e.IsZero() && e.Before(blockedUntil) {
+				blockedUntil = e
+			}
+		}
+		t.Blocked = harMS(c.start, blockedUntil)
+		sent = c.gotConn
+		if !c.wroteRequest.IsZero() {
+			t.Send = harMS(c.gotConn, c.wroteRequest)
+			sent = c.wroteRequest
+		}
+	}
+	received := c.firstByte
+	if received.IsZero() {
+		received = done
+	}
+	t.Wait = math.Max(0, harMS(sent, received))
+	t.Receive = math.Max(0, harMS(received, done))
+	entry.Timings = t
+	entry.Time = math.Max(0, harMS(c.start, done))
+}
+
+// harMS returns the ms elapsed between two events, -1 if either didn't happen
+func harMS(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return -1
+	}
+	return float64(to.Sub(from).Microseconds()) / 1000
+}
+
+// request describes the request with its secrets redacted
+func (c *harCall) request(req *http.Request, body []byte) harRequest {
+	u := *req.URL
+	u.RawQuery = c.redact.query(u.RawQuery)
+	r := harRequest{
+		Method:      req.Method,
+		URL:         u.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     c.cookies(req.Cookies()),
+		Headers:     harHeaders(c.redact.header(req.Header)),
+		QueryString: harQuery(u.RawQuery),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	if len(body) > 0 {
+		ct := req.Header.Get("Content-Type")
+		r.PostData = &harPostData{MimeType: ct, Text: c.redact.body(ct, string(body))}
+	}
+	return r
+}
+
+// response describes the response status and headers with their secrets redacted
+func (c *harCall) response(res *http.Response) harResponse {
+	return harResponse{
+		Status:      res.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, fmt.Sprint(res.StatusCode))),
+		HTTPVersion: res.Proto,
+		Cookies:     c.cookies(res.Cookies()),
+		Headers:     harHeaders(c.redact.header(res.Header)),
+		Content:     harContent{Size: -1, MimeType: res.Header.Get("Content-Type")},
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+// content sets the response body given its size, binary bodies are base64 encoded, bodies
+// larger than harMaxContent are left out
+func (c *harCall) content(entry *harEntry, body []byte, size int) {
+	ct := entry.Response.Content.MimeType
+	entry.Response.Content.Size = size
+	entry.Response.BodySize = size
+	entry.Response.Content.Comment = ""
+	if size > harMaxContent {
+		entry.Response.Content.Comment = fmt.Sprintf(
+			"body not included, larger than %d bytes", harMaxContent)
+	} else if getBodyKind(http.Header{"Content-Type": {ct}}) == bodyBinary || !utf8.Valid(body) {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+		entry.Response.Content.Encoding = "base64"
+	} else {
+		entry.Response.Content.Text = c.redact.body(ct, string(body))
+	}
+}
+
+// cookies lists the cookies, their values are redacted along with the cookie headers
+func (c *harCall) cookies(cookies []*http.Cookie) []harNameValue {
+	hidden := matches(c.redact.rules().headers, "Cookie")
+	nv := []harNameValue{}
+	for _, ck := range cookies {
+		v := ck.Value
+		if hidden {
+			v = redactedValue
+		}
+		nv = append(nv, harNameValue{ck.Name, v})
+	}
+	return nv
+}
+
+// harHeaders lists the headers sorted by name
+func harHeaders(h http.Header) []harNameValue {
+	nv := []harNameValue{}
+	for _, k := range headerNames(h) {
+		for _, v := range h[k] {
+			nv = append(nv, harNameValue{k, v})
+		}
+	}
+	return nv
+}
+
+// harQuery lists the params of a query string in order
+func harQuery(q string) []harNameValue {
+	nv := []harNameValue{}
+	for _, p := range strings.Split(q, "&") {
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		k, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			k = kv[0]
+		}
+		v := ""
+		if len(kv) > 1 {
+			if v, err = url.QueryUnescape(kv[1]); err != nil {
+				v = kv[1]
+			}
+		}
+		nv = append(nv, harNameValue{k, v})
+	}
+	return nv
+}
+
+// harBody captures a streamed response body, up to harMaxContent, and updates its entry once
+// it's closed
+type harBody struct {
+	io.ReadCloser
+	call  *harCall
+	entry *harEntry
+	buf   bytes.Buffer
+	size  int
+	done  bool
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += n
+	if b.size <= harMaxContent {
+		b.buf.Write(p[:n])
+	} else {
+		b.buf = bytes.Buffer{} // too large, drop what we have
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.done {
+		b.done = true
+		b.call.content(b.entry, b.buf.Bytes(), b.size)
+		b.call.timings(b.entry, b.call.har.now())
+		b.call.har.save()
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("HAR export", func() {
+
+	var server *ghttp.Server
+	var c *client
+	var dir string
+	var har *harFile
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+
+	// entries reads back the HAR file
+	entries := func() []*harEntry {
+		js, err := ioutil.ReadFile(har.filename)
+		Ω(err).ShouldNot(HaveOccurred())
+		var doc harDocument
+		Ω(json.Unmarshal(js, &doc)).Should(Succeed())
+		Ω(doc.Log.Version).Should(Equal("1.2"))
+		Ω(doc.Log.Creator.Name).Should(Equal("rs-api"))
+		return doc.Log.Entries
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		dir, _ = ioutil.TempDir("", "har")
+		var err error
+		har, err = newHARFile(filepath.Join(dir, "session.har"))
+		Ω(err).ShouldNot(HaveOccurred())
+		c = &client{httpServer: server.URL(), apiVersion: "1.5", apiKey: "my-key",
+			retry: RetryPolicy{Retries: 1}, har: har}
+		retrySleep = func(ctx context.Context, d time.Duration) error { return nil }
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+		retrySleep = sleepContext
+	})
+
+	It("writes authentication and retries with secrets redacted", func() {
+		server.AppendHandlers(
+			ghttp.RespondWith(200, `{"access_token":"tok","expires_in":7200}`, jsonHeader),
+			ghttp.RespondWith(503, "busy", http.Header{"Content-Type": {"text/plain"}}),
+			ghttp.RespondWith(200, `{"name":"EC2"}`, jsonHeader),
+		)
+		Ω(entries()).Should(BeEmpty())
+		_, err := c.Do(context.Background(), "GET", "/api/clouds/1", []string{"view=default"},
+			"", "")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		e := entries()
+		Ω(e).Should(HaveLen(3))
+		auth := e[0]
+		Ω(auth.Request.Method).Should(Equal("POST"))
+		Ω(auth.Request.URL).Should(HaveSuffix(
+			"/api/oauth2?grant_type=refresh_token&refresh_token=REDACTED"))
+		Ω(auth.Request.QueryString).Should(ContainElement(
+			harNameValue{"refresh_token", "REDACTED"}))
+		Ω(auth.Response.Content.Text).Should(Equal(
+			`{"access_token":"REDACTED","expires_in":7200}`))
+
+		Ω(e[1].Response.Status).Should(Equal(503))
+		Ω(e[1].Response.StatusText).Should(Equal("Service Unavailable"))
+		Ω(e[1].Response.Content.Text).Should(Equal("busy"))
+		Ω(e[2].Request.Headers).Should(ContainElement(
+			harNameValue{"Authorization", "REDACTED"}))
+		Ω(e[2].Request.QueryString).Should(Equal([]harNameValue{{"view", "default"}}))
+		Ω(e[2].Response.Content).Should(Equal(harContent{Size: 14,
+			MimeType: "application/json", Text: `{"name":"EC2"}`}))
+		for _, entry := range e {
+			Ω(entry.Time).Should(BeNumerically(">=", entry.Timings.Wait))
+			Ω(entry.Timings.Send).Should(BeNumerically(">=", 0))
+		}
+	})
+
+	It("captures streamed bodies once they are read", func() {
+		c.authToken = "tok"
+		server.AppendHandlers(
+			ghttp.RespondWith(200, "\x00\x01binary", http.Header{
+				"Content-Type": {"application/octet-stream"}}),
+			ghttp.RespondWith(404, "not found"),
+		)
+		resp, err := c.Do(context.Background(), "GET", "/api/file", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries()).Should(HaveLen(1)) // in case rs-api exits before reading the body
+		Ω(entries()[0].Response.Content.Comment).Should(Equal("body not read"))
+		_, err = ioutil.ReadAll(resp.body)
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.body.Close()
+		Ω(entries()).Should(HaveLen(1))
+		Ω(entries()[0].Response.Content.Encoding).Should(Equal("base64"))
+		Ω(entries()[0].Response.Content.Text).Should(Equal("AAFiaW5hcnk="))
+
+		_, err = c.Do(context.Background(), "PUT", "/api/x", nil, "text/plain", "body")
+		Ω(err).Should(HaveOccurred())
+		e := entries()
+		Ω(e).Should(HaveLen(2))
+		Ω(e[1].Request.PostData).Should(Equal(&harPostData{MimeType: "text/plain",
+			Text: "body"}))
+		Ω(e[1].Response.Status).Should(Equal(404))
+	})
+
+	It("leaves out large streamed bodies", func() {
+		c.authToken = "tok"
+		large := strings.Repeat("x", harMaxContent+1)
+		server.AppendHandlers(ghttp.RespondWith(200, large, http.Header{
+			"Content-Type": {"application/octet-stream"}}))
+		resp, err := c.Do(context.Background(), "GET", "/api/file", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = io.Copy(ioutil.Discard, resp.body)
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.body.Close()
+		Ω(entries()[0].Response.Content).Should(Equal(harContent{Size: harMaxContent + 1,
+			MimeType: "application/octet-stream",
+			Comment:  "body not included, larger than 1048576 bytes"}))
+	})
+})
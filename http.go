@@ -21,21 +21,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
-const requestTimeout = 300 * time.Second // overall timeout for HTTP requests to API
+const defaultRequestTimeout = 300 * time.Second // default timeout for HTTP requests to API
+const defaultConnectTimeout = 30 * time.Second  // default timeout to establish a connection
 
 // recording of a request and its response
 type RequestRecording struct {
@@ -50,22 +56,73 @@ type Recorder func(RequestRecording)
 
 // Client is the handle onto a RightScle client interface.
 // Create a Client object by calling NewClient()
+// Do aborts the request, including any retry sleeps, when ctx is cancelled.
 type Client interface {
 	SetVersion(v string) // sets the RightApi version, either "1.5" or "1.6"
-	Do(method, uri string, args []string, contentType, content string) (*Response, error)
-	SetInsecure()          // makes the client accept broken ssl certs, used in tests
-	SetDebug(debug bool)   // causes each request and response to be logged
-	RecordHttp(r Recorder) // starts recording requests/resp to put into tests
+	Do(ctx context.Context, method, uri string, args []string, contentType, content string) (
+		*Response, error)
+	// DoStream is like Do but leaves a successful json body unread so it can be streamed
+	DoStream(ctx context.Context, method, uri string, args []string) (*Response, error)
+	// NewRequest builds the request Do would send without sending it, for --dry-run
+	NewRequest(ctx context.Context, method, uri string, args []string, contentType,
+		content string) (*http.Request, error)
+	SetInsecure()                           // makes the client accept broken ssl certs, used in tests
+	SetDebug(debug bool)                    // causes each request and response to be logged
+	SetRetry(p RetryPolicy)                 // sets how failed requests are retried
+	SetTimeouts(req, connect time.Duration) // sets per-request and connect timeouts, 0=none
+	RecordHttp(r Recorder)                  // starts recording requests/resp to put into tests
+	Replay(rr []RequestRecording)           // answers requests from recordings, no network
+	SetRedaction(r *redactor)               // sets the secrets hidden in debug output
+	RecordHAR(h *harFile)                   // adds every request/resp to a HAR file
 }
 
 type Response struct {
 	statusCode   int
 	errorMessage string
-	data         interface{}
-	raw          []byte
+	kind         bodyKind      // type of body, decides how it's processed and printed
+	data         interface{}   // decoded body for bodyJSON
+	raw          []byte        // body for all but bodyBinary
+	body         io.ReadCloser // unread body for bodyBinary or DoStream, must be closed
 	header       http.Header
 }
 
+// bodyKind classifies response bodies by their content-type
+type bodyKind int
+
+const (
+	bodyJSON   bodyKind = iota // json, decoded into Response.data
+	bodyText                   // text/*, printed verbatim
+	bodyXML                    // xml, printed verbatim
+	bodyBinary                 // anything else, streamed
+)
+
+// String returns a name for the kind of body for use in error messages
+func (k bodyKind) String() string {
+	return [...]string{"json", "text", "xml", "binary"}[k]
+}
+
+// getBodyKind determines the kind of body given the response headers, a missing content-type
+// is assumed to be json for compatibility with older RL10 versions
+func getBodyKind(h http.Header) bodyKind {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return bodyJSON
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	switch {
+	case err != nil:
+		return bodyBinary
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		return bodyJSON
+	case mt == "application/xml" || mt == "text/xml" || strings.HasSuffix(mt, "+xml"):
+		return bodyXML
+	case strings.HasPrefix(mt, "text/"):
+		return bodyText
+	default:
+		return bodyBinary
+	}
+}
+
 //===== Client data structure and helper functions
 
 // An rsclient.client is a handle to perform HTTP requests to the RightScale platform.
@@ -80,7 +137,10 @@ type client struct {
 	authToken   string      // OAuth authentication token used in every direct request
 	apiKey      string      // API key for direct connections
 	proxySecret string      // proxy secret for RL10 proxied connections
+	retry       RetryPolicy // how to retry failed requests
 	recorder    Recorder    // where to record req/resp to put into tests
+	redact      *redactor   // secrets to hide in debug output, nil for the built-in rules
+	har         *harFile    // where to trace every request attempt, see har.go
 }
 
 // Set debugging
@@ -88,14 +148,49 @@ func (c *client) SetDebug(debug bool) {
 	c.debug = debug
 }
 
+// transport returns the client's http transport, creating one if necessary
+func (c *client) transport() *http.Transport {
+	if tr, ok := c.cl.Transport.(*http.Transport); ok {
+		return tr
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	c.cl.Transport = tr
+	return tr
+}
+
 // Make client not check SSL cert, this is used in the test suite
 func (c *client) SetInsecure() {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+	c.transport().TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
 	}
-	c.cl = http.Client{Transport: tr}
+}
+
+// Set the timeout for each request (i.e. each attempt) and the timeout to establish a
+// connection, including the TLS handshake
+func (c *client) SetTimeouts(req, connect time.Duration) {
+	c.cl.Timeout = req
+	tr := c.transport()
+	tr.DialContext = (&net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = connect
+}
+
+// Set the retry policy
+func (c *client) SetRetry(p RetryPolicy) {
+	c.retry = p
+}
+
+// Answer all requests from the recorded interactions instead of using the network, see
+// replay.go. This replaces the transport, so it must be called after SetInsecure and
+// SetTimeouts.
+func (c *client) Replay(rr []RequestRecording) {
+	t := newReplayTransport(rr)
+	t.redact = c.redact
+	c.cl.Transport = t
+}
+
+// Set the secrets hidden in debug output and ignored when replaying, see redact.go
+func (c *client) SetRedaction(r *redactor) {
+	c.redact = r
 }
 
 // Add a recorder for HTTP requests, this is used to generate test fixtures
@@ -103,6 +198,11 @@ func (c *client) RecordHttp(r Recorder) {
 	c.recorder = r
 }
 
+// Add every request attempt to a HAR file, this is used for troubleshooting
+func (c *client) RecordHAR(h *harFile) {
+	c.har = h
+}
+
 // Given a URI such as /api/instances create a full URL
 func (c *client) makeURL(uri string) string {
 	if !strings.HasPrefix(uri, "/") {
@@ -111,6 +211,15 @@ func (c *client) makeURL(uri string) string {
 	return c.httpServer + uri
 }
 
+// Given a URI and query string args create the full URL of a request
+func (c *client) requestURL(uri string, args []string) string {
+	uri = c.makeURL(uri)
+	if args != nil {
+		uri += "?" + strings.Join(args, "&")
+	}
+	return uri
+}
+
 // Set the API version
 func (c *client) SetVersion(v string) {
 	c.apiVersion = v
@@ -180,24 +289,24 @@ func NewProxyClient(proxyHost, secret string, debug bool) (Client, error) {
 		proxySecret: rllSecret,
 		apiVersion:  "1.5",
 		debug:       debug,
+		retry:       DefaultRetryPolicy,
 	}
-	c.cl.Timeout = requestTimeout
+	c.SetTimeouts(defaultRequestTimeout, defaultConnectTimeout)
 	return c, nil
 }
 
 //===== Auth stuff =====
 
+// NewDirectClient creates a client that talks to the RS platform directly, it authenticates
+// when the first request is made so the retry policy and timeouts apply to the auth request
 func NewDirectClient(httpServer, apiKey string, debug bool) (Client, error) {
-	if !strings.HasPrefix(httpServer, "https:") {
+	// plain http is only used when asked for explicitly, e.g. to talk to rs-api mock-server
+	if !strings.HasPrefix(httpServer, "https:") && !strings.HasPrefix(httpServer, "http:") {
 		httpServer = "https://" + httpServer
 	}
-	c := &client{httpServer: httpServer, apiKey: apiKey, apiVersion: "1.5", debug: debug}
-	c.cl.Timeout = requestTimeout
-	err := c.authenticate()
-	if err != nil {
-		return nil, err
-	}
-
+	c := &client{httpServer: httpServer, apiKey: apiKey, apiVersion: "1.5", debug: debug,
+		retry: DefaultRetryPolicy}
+	c.SetTimeouts(defaultRequestTimeout, defaultConnectTimeout)
 	return c, nil
 }
 
@@ -213,10 +322,12 @@ type authResponse struct {
 }
 */
 
-// Perform an authentication request and save the oauth token in the client
-func (c *client) authenticate() error {
-	resp, err := c.Do("POST", "/api/oauth2", []string{
-		"grant_type=refresh_token", "refresh_token=" + c.apiKey}, "", "")
+// Perform an authentication request and save the oauth token in the client, the request is
+// a POST but it's safe to retry because it has no side-effects
+func (c *client) authenticate(ctx context.Context) error {
+	c.authToken = "" // don't send a stale token, also prevents re-authentication loops
+	resp, err := c.do(ctx, "POST", "/api/oauth2", []string{
+		"grant_type=refresh_token", "refresh_token=" + c.apiKey}, "", "", true, false)
 	if err != nil {
 		msg := err.Error()
 		if resp != nil && resp.data != nil {
@@ -255,7 +366,9 @@ func readBody(resp *http.Response) ([]byte, error) {
 }
 
 // logRequest logs a request and dumps request & response if there was an error
-func logRequest(err error, req *http.Request, reqDump []byte, resp *http.Response) {
+func logRequest(err error, req *http.Request, reqDump []byte, resp *http.Response,
+	redact *redactor) {
+
 	// short-hand function to print to stderr
 	logf := func(format string, args ...interface{}) {
 		fmt.Fprintf(os.Stderr, format, args...)
@@ -272,22 +385,27 @@ func logRequest(err error, req *http.Request, reqDump []byte, resp *http.Respons
 			logf("HTTP %s %s returned %s\n", req.Method, req.URL.Path, resp.Status)
 			logf("===== REQUEST =====\n%s\n", reqDump)
 			dump, _ := httputil.DumpResponse(resp, true)
-			logf("===== RESPONSE =====\n%s\n", dump)
+			logf("===== RESPONSE =====\n%s\n", redact.dump(dump))
 		} else { // 2XX - all ok
 			logf("HTTP %s %s -> %s\n", req.Method, req.URL.Path, resp.Status)
 		}
 	}
 }
 
-var noAuthHeader = regexp.MustCompile(`(?im)^Authorization:.*$`)
-
 // construct a queryString from the args, which is a map to strings or arrays of strings, for
 // example: { "view": "expanded", "filter[]": [ "name==my_name", "cloud_href==/api/clouds/1" ] }
-// both the key and the value of the map will be URL-encoded
+// both the key and the value of the map will be URL-encoded, the keys are sorted so the query
+// string doesn't depend on the map's iteration order
 func queryStringArgs(args map[string]interface{}) string {
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 	qs := ""   // query string we're building
 	conn := "" // connector between clauses, i.e., "&" after the first
-	for k, v := range args {
+	for _, k := range keys {
+		v := args[k]
 		if s, ok := v.(string); ok {
 			qs += conn + url.QueryEscape(k) + "=" + url.QueryEscape(s)
 		} else if l, ok := v.([]string); ok {
@@ -303,13 +421,17 @@ func queryStringArgs(args map[string]interface{}) string {
 	return qs
 }
 
+// parseResponseBody decodes a json response body, numbers are decoded as json.Number so large
+// integers, such as IDs, retain their precision
 func parseResponseBody(body io.Reader) (interface{}, error) {
 	if body == nil {
 		return nil, nil
 	}
 
 	var data interface{}
-	err := json.NewDecoder(body).Decode(&data)
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	err := dec.Decode(&data)
 	if err == io.EOF {
 		return nil, nil
 	} else if err != nil {
@@ -321,25 +443,32 @@ func parseResponseBody(body io.Reader) (interface{}, error) {
 	return data, nil
 }
 
-func processResponse(req *http.Request, resp *http.Response) (*Response, error) {
+// processResponse reads and possibly decodes the response body according to its content-type,
+// binary bodies of successful responses, and json bodies if stream is set, are left unread so
+// they can be streamed
+func processResponse(req *http.Request, resp *http.Response, stream bool) (*Response, error) {
 	r := Response{statusCode: resp.StatusCode, header: resp.Header}
 	if resp.StatusCode >= 200 && resp.StatusCode < 299 {
+		r.kind = getBodyKind(resp.Header)
+		if r.kind == bodyBinary || stream && r.kind == bodyJSON {
+			r.body = resp.Body
+			return &r, nil
+		}
 		var err error
 		r.raw, err = readBody(resp)
-		if err == nil {
+		if err == nil && r.kind == bodyJSON {
 			r.data, err = parseResponseBody(resp.Body)
 		}
 		if err != nil {
-			return nil, fmt.Errorf("HTTP %s %s: %s",
-				req.Method, req.URL.Path, err.Error())
+			return nil, fmt.Errorf("HTTP %s %s: %w", req.Method, req.URL.Path, err)
 		}
 		return &r, nil
 	} else if resp.Body != nil {
 		var err error
 		r.raw, err = readBody(resp)
 		if err != nil {
-			return nil, fmt.Errorf("HTTP %s %s error reading response body: %s",
-				req.Method, req.URL.Path, err.Error())
+			return nil, fmt.Errorf("HTTP %s %s error reading response body: %w",
+				req.Method, req.URL.Path, err)
 		}
 		r.data, _ = parseResponseBody(resp.Body) // in case there's a json error body
 		r.errorMessage = string(r.raw)
@@ -351,54 +480,143 @@ func processResponse(req *http.Request, resp *http.Response) (*Response, error)
 }
 
 // Same as http.Client.Post but just pass URI, like /api/instances
-func (c *client) Do(method string, uri string, args []string, contentType, content string) (
+func (c *client) Do(ctx context.Context, method string, uri string, args []string,
+	contentType, content string) (*Response, error) {
+
+	return c.authenticatedDo(ctx, method, uri, args, contentType, content, false)
+}
+
+// Same as Do but the body of a successful json response is left unread in Response.body
+// instead of being decoded, so large collections can be printed as they are received
+func (c *client) DoStream(ctx context.Context, method string, uri string, args []string) (
 	*Response, error) {
 
-	uri = c.makeURL(uri)
-	if args != nil {
-		uri += "?" + strings.Join(args, "&")
+	return c.authenticatedDo(ctx, method, uri, args, "", "", true)
+}
+
+// authenticatedDo authenticates a direct client that doesn't have an auth token yet and then
+// performs the request, the auth request itself is never streamed
+func (c *client) authenticatedDo(ctx context.Context, method string, uri string,
+	args []string, contentType, content string, stream bool) (*Response, error) {
+
+	if c.apiKey != "" && c.authToken == "" {
+		if err := c.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c.do(ctx, method, uri, args, contentType, content, idempotentMethods[method],
+		stream)
+}
+
+// NewRequest builds the request Do would send without sending it. A direct client only gets
+// its auth token when the first request is made, until then a placeholder is used.
+func (c *client) NewRequest(ctx context.Context, method, uri string, args []string,
+	contentType, content string) (*http.Request, error) {
+
+	req, err := c.newRequest(ctx, method, c.requestURL(uri, args), contentType, []byte(content))
+	if err == nil && c.apiKey != "" && c.authToken == "" {
+		req.Header.Set("Authorization", "Bearer "+redactedValue)
 	}
-	req, err := http.NewRequest(method, uri, strings.NewReader(content))
+	return req, err
+}
+
+// newRequest creates a fresh request with its own reader onto the body, this is needed for
+// each attempt because sending a request consumes its body. GetBody is set so the std http
+// client can produce yet another copy of the body should it need to follow a redirect.
+func (c *client) newRequest(ctx context.Context, method, url, contentType string,
+	body []byte) (*http.Request, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
 
 	c.setHeaders(req.Header)
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
-	dump, _ := httputil.DumpRequestOut(req, true)
-	dump = noAuthHeader.ReplaceAll(dump, []byte("Authorization: Bearer <hidden>"))
+	return req, nil
+}
+
+// do performs the request, retrying according to the client's retry policy, safe indicates
+// whether the request can be repeated without ill effects, stream whether the body of a
+// successful json response is left unread. A direct client whose auth token
+// is rejected re-authenticates once and then repeats the request.
+func (c *client) do(ctx context.Context, method string, uri string, args []string,
+	contentType, content string, safe, stream bool) (*Response, error) {
+
+	uri = c.requestURL(uri, args)
+	body := []byte(content)
+	reauth := c.apiKey != "" && c.authToken != ""
+
+	for attempt := 1; ; attempt++ {
+		req, err := c.newRequest(ctx, method, uri, contentType, body)
+		if err != nil {
+			return nil, err
+		}
+		var dump []byte
+		if c.debug {
+			dump, _ = httputil.DumpRequestOut(req, true)
+			dump = c.redact.dump(dump)
+		}
 
-	try := 1
-	for {
-		//fmt.Fprintf(os.Stderr, "HTTP.DO: %s %s\n", req.Method, req.URL)
 		// perform the request
-		var res *http.Response
-		res, err = c.cl.Do(req)
-		//fmt.Fprintf(os.Stderr, "Err=%v Resp=%#v\n", err, res)
+		var resp *Response
+		var call *harCall
+		if c.har != nil {
+			req, call = c.har.start(req, c.redact)
+		}
+		res, err := c.cl.Do(req)
 
 		// log every iteration
 		if c.debug {
-			logRequest(err, req, dump, res)
+			logRequest(err, req, dump, res, c.redact)
 		}
 
-		// if the request didn't happen, retry
-		// TODO: need to be careful with timeouts!
-		if err != nil {
-			try += 1
-			if try >= 3 {
-				return nil, err
+		// process the response, which extracts json
+		if err == nil {
+			resp, err = processResponse(req, res, stream)
+		}
+		if call != nil {
+			call.finish(req, body, res, resp, err)
+		}
+
+		// our token may have expired, get a fresh one and try again, this doesn't count as
+		// a retry
+		if resp != nil && resp.statusCode == http.StatusUnauthorized && reauth {
+			reauth = false
+			if c.debug {
+				fmt.Fprintf(os.Stderr, "HTTP %s %s: re-authenticating\n", method,
+					req.URL.Path)
+			}
+			if err := c.authenticate(ctx); err != nil {
+				return resp, err
 			}
+			attempt--
 			continue
 		}
 
-		// process the response, which extracts json
-		resp, err := processResponse(req, res)
-
-		if resp.statusCode < 500 || try >= 3 {
-			// success or our error, return what we got after recording
-			if c.recorder != nil {
+		// a request that timed out already took as long as we're willing to wait, retrying
+		// it would multiply the time until rs-api gives up by the number of retries
+		wait, retry := c.retry.next(attempt, safe, resp)
+		if isTimeout(err) {
+			retry = false
+		}
+		if !retry {
+			// success, our error, or out of retries: return what we got after recording
+			if resp != nil && c.recorder != nil {
+				if resp.body != nil {
+					// can't stream the body if we need to record it
+					resp.raw, err = ioutil.ReadAll(resp.body)
+					resp.body.Close()
+					resp.body = ioutil.NopCloser(bytes.NewReader(resp.raw))
+					if err != nil {
+						return nil, err
+					}
+				}
 				c.recorder(RequestRecording{
 					Verb: method, Uri: uri,
 					ReqHeader:  req.Header,
@@ -412,6 +630,17 @@ func (c *client) Do(method string, uri string, args []string, contentType, conte
 			return resp, err
 		}
 
-		try += 1
+		if c.debug {
+			fmt.Fprintf(os.Stderr, "HTTP %s %s: retrying in %s\n", method, req.URL.Path, wait)
+		}
+		if err := retrySleep(ctx, wait); err != nil {
+			return resp, err
+		}
 	}
 }
+
+// isTimeout returns whether the error returned by Client.Do is due to a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Retrying requests", func() {
+
+	var server *ghttp.Server
+	var c *client
+	var waits []time.Duration
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		c = &client{httpServer: server.URL(), apiVersion: "1.5",
+			retry: RetryPolicy{Retries: 3, MaxWait: 10 * time.Second}}
+		waits = nil
+		retrySleep = func(ctx context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		retrySleep = sleepContext
+	})
+
+	It("retries a GET that gets a 503", func() {
+		server.AppendHandlers(
+			ghttp.RespondWith(503, "busy"),
+			ghttp.RespondWith(200, `{"a":1}`,
+				http.Header{"Content-Type": []string{"application/json"}}),
+		)
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(200))
+		Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		Ω(waits).Should(HaveLen(1))
+	})
+
+	It("gives up after the configured number of retries", func() {
+		c.retry.Retries = 2
+		server.AppendHandlers(
+			ghttp.RespondWith(502, ""),
+			ghttp.RespondWith(502, ""),
+			ghttp.RespondWith(502, ""),
+		)
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(502))
+		Ω(server.ReceivedRequests()).Should(HaveLen(3))
+	})
+
+	It("does not retry a 500", func() {
+		server.AppendHandlers(ghttp.RespondWith(500, "oops"))
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(500))
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("honors Retry-After", func() {
+		server.AppendHandlers(
+			ghttp.RespondWith(429, "", http.Header{"Retry-After": []string{"7"}}),
+			ghttp.RespondWith(204, ""),
+		)
+		_, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(waits).Should(Equal([]time.Duration{7 * time.Second}))
+	})
+
+	It("gives up if Retry-After exceeds the max wait", func() {
+		server.AppendHandlers(
+			ghttp.RespondWith(503, "", http.Header{"Retry-After": []string{"60"}}),
+		)
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(503))
+		Ω(waits).Should(BeEmpty())
+	})
+
+	It("does not retry a POST unless told to", func() {
+		server.AppendHandlers(ghttp.RespondWith(503, ""))
+		resp, err := c.Do(context.Background(), "POST", "/api/deployments", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(503))
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("retries a POST with Unsafe", func() {
+		c.retry.Unsafe = true
+		server.AppendHandlers(
+			ghttp.RespondWith(503, ""),
+			ghttp.RespondWith(201, ""),
+		)
+		resp, err := c.Do(context.Background(), "POST", "/api/deployments", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(201))
+	})
+
+	It("retries a POST that gets a 429", func() {
+		server.AppendHandlers(
+			ghttp.RespondWith(429, ""),
+			ghttp.RespondWith(201, ""),
+		)
+		resp, err := c.Do(context.Background(), "POST", "/api/deployments", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.statusCode).Should(Equal(201))
+	})
+
+	It("backs off exponentially with jitter", func() {
+		p := RetryPolicy{MaxWait: 5 * retryBaseWait}
+		for i := 0; i < 20; i++ {
+			Ω(p.backoff(2)).Should(BeNumerically(">=", retryBaseWait/2))
+			Ω(p.backoff(2)).Should(BeNumerically("<=", retryBaseWait))
+			Ω(p.backoff(4)).Should(BeNumerically(">=", 2*retryBaseWait))
+			Ω(p.backoff(4)).Should(BeNumerically("<=", 4*retryBaseWait))
+			Ω(p.backoff(10)).Should(BeNumerically("<=", p.MaxWait))
+		}
+	})
+
+	It("parses Retry-After dates", func() {
+		now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+		h := http.Header{"Retry-After": []string{"Mon, 01 Jun 2015 12:00:42 GMT"}}
+		wait, ok := retryAfter(h, now)
+		Ω(ok).Should(BeTrue())
+		Ω(wait).Should(Equal(42 * time.Second))
+
+		_, ok = retryAfter(http.Header{"Retry-After": []string{"soon"}}, now)
+		Ω(ok).Should(BeFalse())
+	})
+
+})
+
+var _ = Describe("Replaying request bodies", func() {
+
+	var server *ghttp.Server
+	var c *client
+	var bodies []string
+
+	// handler that records the body it received
+	recordBody := func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(b))
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		c = &client{httpServer: server.URL(), apiVersion: "1.5",
+			retry: RetryPolicy{Retries: 3, MaxWait: 10 * time.Second}}
+		bodies = nil
+		retrySleep = func(ctx context.Context, d time.Duration) error { return nil }
+	})
+
+	AfterEach(func() {
+		server.Close()
+		retrySleep = sleepContext
+	})
+
+	It("sends the body on every attempt", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/rll/env/RS_SELF_HREF"),
+				ghttp.VerifyHeaderKV("Content-Type", "text/plain"),
+				recordBody,
+				ghttp.RespondWith(503, ""),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/rll/env/RS_SELF_HREF"),
+				recordBody,
+				ghttp.RespondWith(204, ""),
+			),
+		)
+		_, err := c.Do(context.Background(), "PUT", "/rll/env/RS_SELF_HREF", nil, "text/plain",
+			"/api/clouds/1/instances/123")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bodies).Should(Equal([]string{
+			"/api/clouds/1/instances/123", "/api/clouds/1/instances/123"}))
+	})
+
+	It("sends the body after a redirect", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				recordBody,
+				ghttp.RespondWith(307, "", http.Header{"Location": []string{"/other"}}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/other"),
+				recordBody,
+				ghttp.RespondWith(204, ""),
+			),
+		)
+		_, err := c.Do(context.Background(), "PUT", "/rll/env/X", nil, "text/plain", "some value")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bodies).Should(Equal([]string{"some value", "some value"}))
+	})
+
+	It("sends the body again after re-authenticating", func() {
+		c.apiKey = "my-key"
+		c.authToken = "expired-token"
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Authorization", "Bearer expired-token"),
+				recordBody,
+				ghttp.RespondWith(401, ""),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/api/oauth2",
+					"grant_type=refresh_token&refresh_token=my-key"),
+				ghttp.RespondWith(200, `{"access_token":"fresh-token"}`,
+					http.Header{"Content-Type": []string{"application/json"}}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Authorization", "Bearer fresh-token"),
+				recordBody,
+				ghttp.RespondWith(204, ""),
+			),
+		)
+		_, err := c.Do(context.Background(), "PUT", "/api/x", nil, "text/plain", "payload")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bodies).Should(Equal([]string{"payload", "payload"}))
+	})
+
+})
+
+var _ = Describe("Timeouts and cancellation", func() {
+
+	var server *ghttp.Server
+	var c *client
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		c = &client{httpServer: server.URL(), apiVersion: "1.5",
+			retry: RetryPolicy{Retries: 3, MaxWait: 10 * time.Second}}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("times out slow requests", func() {
+		c.retry.Retries = 0
+		c.SetTimeouts(50*time.Millisecond, time.Second)
+		server.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		})
+		_, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(isTimeout(err)).Should(BeTrue())
+	})
+
+	It("does not retry a GET that timed out", func() {
+		c.SetTimeouts(50*time.Millisecond, time.Second)
+		server.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		})
+		_, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(isTimeout(err)).Should(BeTrue())
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("does not retry a GET whose body stalled", func() {
+		c.SetTimeouts(100*time.Millisecond, time.Second)
+		server.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":`))
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		})
+		_, err := c.Do(context.Background(), "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(isTimeout(err)).Should(BeTrue())
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("stops sleeping between retries when cancelled", func() {
+		server.AppendHandlers(
+			ghttp.RespondWith(503, "", http.Header{"Retry-After": []string{"5"}}),
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := c.Do(ctx, "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(Equal(context.Canceled))
+		Ω(isTimeout(err)).Should(BeFalse())
+		Ω(time.Since(start)).Should(BeNumerically("<", time.Second))
+	})
+
+	It("cancels requests in flight", func() {
+		server.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := c.Do(ctx, "GET", "/api/clouds", nil, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(errors.Is(err, context.Canceled)).Should(BeTrue())
+	})
+
+})
+
+var _ = Describe("Response content types", func() {
+
+	var server *ghttp.Server
+	var c *client
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		c = &client{httpServer: server.URL(), apiVersion: "1.5"}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	respondWith := func(contentType, body string) {
+		server.AppendHandlers(ghttp.RespondWith(200, body,
+			http.Header{"Content-Type": []string{contentType}}))
+	}
+
+	It("decodes vendor json", func() {
+		respondWith("application/vnd.rightscale.cloud+json;charset=utf-8", `{"id":1}`)
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds/1", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.kind).Should(Equal(bodyJSON))
+		Ω(resp.data).Should(HaveKey("id"))
+	})
+
+	It("keeps text verbatim", func() {
+		respondWith("text/plain", "#!/bin/bash\necho hello\n")
+		resp, err := c.Do(context.Background(), "GET", "/api/right_scripts/1/source",
+			nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.kind).Should(Equal(bodyText))
+		Ω(string(resp.raw)).Should(Equal("#!/bin/bash\necho hello\n"))
+	})
+
+	It("keeps xml verbatim", func() {
+		respondWith("application/vnd.rightscale.cloud+xml", "<cloud/>")
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds/1.xml", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.kind).Should(Equal(bodyXML))
+		Ω(string(resp.raw)).Should(Equal("<cloud/>"))
+	})
+
+	It("leaves binary bodies unread for streaming", func() {
+		respondWith("application/octet-stream", "\x00\x01\x02")
+		resp, err := c.Do(context.Background(), "GET", "/api/attachments/1", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.kind).Should(Equal(bodyBinary))
+		Ω(resp.raw).Should(BeEmpty())
+		b, _ := ioutil.ReadAll(resp.body)
+		resp.body.Close()
+		Ω(b).Should(Equal([]byte("\x00\x01\x02")))
+	})
+
+})
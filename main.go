@@ -4,13 +4,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jmoiron/jsonq"
 	"github.com/rightscale/go-jsonselect"
@@ -21,9 +30,29 @@ import (
 // everything each time we run a recorded test
 
 var app *kingpin.Application
-var host, rsKey, x1, xm, xj, xh, recordFile, actionName, resourceHref *string
-var debugFlag, prettyFlag, rl10Flag *bool
-var arguments *[]string
+var host, rsKey, x1, xm, xj, x0, xo, xpaths, recordFile, replayFile, actionName, resourceHref *string
+var accept, formatFlag, output, columns, templateText, templateFile, query, queryMode *string
+var xFormat, harFlag *string
+var debugFlag, prettyFlag, rl10Flag, retryUnsafe, exportFlag, rawFlag, xs, explainFlag *bool
+var firstFlag, lastFlag, failEmpty, jsonlFlag, dryRunFlag, curlFlag *bool
+var retries *int
+var retryMaxWait, timeout, connectTimeout *time.Duration
+var arguments, xv, xh, redactHeaders, redactParams, redactFields *[]string
+var defaultValue optionalString
+
+// optionalString is a flag value that records whether the flag was specified at all, so an
+// empty string can be distinguished from no value
+type optionalString struct {
+	value string
+	set   bool
+}
+
+func (o *optionalString) Set(v string) error {
+	o.value, o.set = v, true
+	return nil
+}
+
+func (o *optionalString) String() string { return o.value }
 
 func initKingpin() {
 	app = kingpin.New("rs-api", `RightScale/RightLink10 API 1.5/1.6 Command Line Client
@@ -54,10 +83,34 @@ Non-zero exit codes indicate a problem
 	host = app.Flag("host", "host:port for API endpoint or RL10 proxy").String()
 	rsKey = app.Flag("key", "RightScale API key or RL10 proxy secret").String()
 	prettyFlag = app.Flag("pretty", "pretty-print json output").Bool()
+	accept = app.Flag("accept", "media type to request, json or xml").
+		Default("json").Enum("json", "xml")
+	formatFlag = app.Flag("format", "output format: json, table, csv, tsv, or yaml").
+		Default("json").Enum("json", "table", "csv", "tsv", "yaml")
+	output = app.Flag("output", "write the response to the named file instead of stdout").
+		String()
+	columns = app.Flag("columns", "comma-separated columns for table, csv, and tsv output, "+
+		"ex: name,state,public_ip_addresses[0]").String()
+	jsonlFlag = app.Flag("jsonl", "print each resource of a collection as json on its own "+
+		"line as the response is received").Bool()
+	templateText = app.Flag("template", "print the response using a Go text/template, "+
+		"ex: '{{.name}} {{rel \"self\" .}}'").String()
+	templateFile = app.Flag("template-file", "print the response using the Go text/template "+
+		"in the named file").String()
 	//fetchFlag   = app.Flag("fetch", "auto-fetch resource returned in Location header").Bool()
 	//noRedirFlag = app.Flag("noRedirect", "do not follow any redirects").Bool()
 	rl10Flag = app.Flag("rl10", "use RightLink10 proxy and auto-detect port/secret "+
 		"unless -host flag is provided").Bool()
+	retries = app.Flag("retries", "max number of retries of requests that fail due to "+
+		"network errors or transient server errors (429, 502, 503, 504)").Default("3").Int()
+	retryMaxWait = app.Flag("retry-max-wait", "max time to wait between retries, also the "+
+		"longest Retry-After delay honored").Default("30s").Duration()
+	retryUnsafe = app.Flag("retry-unsafe", "also retry non-idempotent requests (POST) that "+
+		"may have executed on the server").Bool()
+	timeout = app.Flag("timeout", "timeout for each HTTP request, 0 for none").
+		Default("300s").Duration()
+	connectTimeout = app.Flag("connect-timeout", "timeout to establish a connection to the "+
+		"API endpoint or proxy, 0 for none").Default("30s").Duration()
 
 	actionName = app.Arg("action", "name of action, ex: index, create, delete, launch, ...").
 		Required().String()
@@ -72,9 +125,58 @@ Non-zero exit codes indicate a problem
 		"print one value per line").String()
 	xj = app.Flag("xj", "extract data from response using json:select, "+
 		"print values as json array on one line").String()
-	xh = app.Flag("xh", "extract value of named header and print on one line").String()
+	x0 = app.Flag("x0", "extract multiple values from response using json:select, "+
+		"print values unquoted and terminated by NUL characters, ex: for xargs -0").String()
+	xo = app.Flag("xo", "extract fields from each resource using json:select expressions "+
+		"relative to the resource, print one json object per resource, or one row with "+
+		"--format table, csv, or tsv, ex: --xo 'name=.name,state=.state'").String()
+	xpaths = app.Flag("xpaths", "extract multiple values from response using json:select, "+
+		"print the json pointer of each match (all candidates if identical values make it "+
+		"ambiguous) and the value on one line").String()
+	explainFlag = app.Flag("explain", "when --x1 does not select exactly one value, show the "+
+		"paths of the candidate values").Bool()
+	defaultValue = optionalString{}
+	app.Flag("default", "value to print when --x1 or --xv select nothing").
+		SetValue(&defaultValue)
+	firstFlag = app.Flag("first", "print the first value when --x1 or --xv select "+
+		"multiple values").Bool()
+	lastFlag = app.Flag("last", "print the last value when --x1 or --xv select "+
+		"multiple values").Bool()
+	failEmpty = app.Flag("fail-empty", "exit with code 7 when --xm, --xj, --x0, --xo, "+
+		"--xpaths, or --query select nothing").Bool()
+	rawFlag = app.Flag("raw", "print extracted strings without json quotes for --x1, --xm, "+
+		"and --query").Bool()
+	xh = app.Flag("xh", "extract value of named header and print on one line, "+
+		"repeatable").Strings()
+	xs = app.Flag("xs", "extract the HTTP status code and print on one line").Bool()
+	xFormat = app.Flag("extract-format", "how to print the status, headers, and values when "+
+		"combining --xs or --xh with other extractions: lines or json").
+		Default("lines").Enum("lines", "json")
+	xv = app.Flag("xv", "extract single value using json:select and print it as a shell "+
+		"variable assignment, repeatable, ex: --xv 'NAME=.name'").Strings()
+	exportFlag = app.Flag("export", "print --xv assignments as export statements").Bool()
+	query = app.Flag("query", "extract data from response using a JMESPath expression, "+
+		"an array result produces multiple values, see --query-mode").String()
+	queryMode = app.Flag("query-mode", "how to print --query values: single (like --x1), "+
+		"multi (like --xm), or json (like --xj)").Default("multi").
+		Enum("single", "multi", "json")
 	recordFile = app.Flag("record", "for test generation purposes, specifies a file to record "+
 		"all requests").String()
+	replayFile = app.Flag("replay", "answer requests from the interactions recorded in the "+
+		"named cassette file instead of contacting the API, for testing scripts").String()
+	redactHeaders = app.Flag("redact-header", "hide the value of headers matching the regexp "+
+		"in recordings and --debug output, repeatable").Strings()
+	redactParams = app.Flag("redact-param", "hide the value of query or form params matching "+
+		"the regexp in recordings and --debug output, repeatable").Strings()
+	redactFields = app.Flag("redact-field", "hide the value of json body fields matching the "+
+		"regexp in recordings and --debug output, repeatable").Strings()
+	harFlag = app.Flag("har", "write every request and response, including authentication "+
+		"and retries, with timings and secrets redacted, to the named file in HAR format").
+		String()
+	dryRunFlag = app.Flag("dry-run", "print the method, URL, headers (secrets redacted), and "+
+		"body of the request instead of sending it").Bool()
+	curlFlag = app.Flag("curl", "print an equivalent curl command instead of sending the "+
+		"request, secrets are redacted").Bool()
 }
 
 func init() { kingpin.Version(VV) }
@@ -89,6 +191,33 @@ func init() {
 	}
 }
 
+//===== Exit codes
+
+const (
+	exitTimeout   = 124 // a request timed out, same as timeout(1)
+	exitInterrupt = 130 // interrupted by SIGINT or SIGTERM, same as bash
+	exitEmpty     = 7   // nothing was extracted with --fail-empty
+)
+
+// fatalIfError is like kingpin.FatalIfError for errors returned by Client.Do but exits with a
+// distinct exit code when the request timed out or was interrupted
+func fatalIfError(err error, prefix string) {
+	if err == nil {
+		return
+	}
+	code := exitTimeout
+	if errors.Is(err, context.Canceled) {
+		code = exitInterrupt
+	} else if !isTimeout(err) {
+		kingpin.FatalIfError(err, prefix)
+	}
+	if prefix != "" {
+		prefix += ": "
+	}
+	fmt.Fprintf(os.Stderr, "rs-api: error: %s%s\n", prefix, err.Error())
+	os.Exit(code)
+}
+
 //===== Overrides for testing
 
 var osExit = os.Exit
@@ -107,12 +236,32 @@ var rightscale = func() Client {
 	}
 
 	var err error
+	redaction, err = newRedactor(*redactHeaders, *redactParams, *redactFields)
+	kingpin.FatalIfError(err, "")
+
+	var replay []RequestRecording
+	h, k := *host, *rsKey
+	if *replayFile != "" {
+		recs, err := readCassette(*replayFile)
+		kingpin.FatalIfError(err, "")
+		for _, r := range recs {
+			replay = append(replay, r.Interactions...)
+		}
+		// requests never leave the process, so there's no need to locate the proxy
+		if *rl10Flag && h == "" {
+			h = "localhost:0"
+		}
+		if *rl10Flag && k == "" {
+			k = "replay"
+		}
+	}
+
 	if *rl10Flag {
 		// we're gonna use the RL10 proxy
 		if *debugFlag {
 			fmt.Fprintf(os.Stderr, "Using RightLink10 proxy\n")
 		}
-		rsClientInternal, err = NewProxyClient(*host, *rsKey, *debugFlag)
+		rsClientInternal, err = NewProxyClient(h, k, *debugFlag)
 		if err != nil {
 			kingpin.FatalIfError(err, "")
 		}
@@ -121,11 +270,9 @@ var rightscale = func() Client {
 		if *debugFlag {
 			fmt.Fprintf(os.Stderr, "Going direct to RightScale\n")
 		}
-		h := *host
 		if h == "" {
 			h = os.Getenv("RS_api_hostname")
 		}
-		k := *rsKey
 		if k == "" {
 			k = os.Getenv("RS_api_key")
 		}
@@ -135,23 +282,42 @@ var rightscale = func() Client {
 		}
 	}
 
+	rsClientInternal.SetRetry(RetryPolicy{
+		Retries: *retries, MaxWait: *retryMaxWait, Unsafe: *retryUnsafe})
+	rsClientInternal.SetTimeouts(*timeout, *connectTimeout)
+	rsClientInternal.SetRedaction(redaction)
+
+	if *replayFile != "" {
+		// recordings only hold the final attempt of each request, so don't retry
+		rsClientInternal.SetRetry(RetryPolicy{})
+		rsClientInternal.Replay(replay)
+	}
+
 	if *recordFile != "" {
 		rsClientInternal.RecordHttp(recorder)
 	}
 
+	if *harFlag != "" {
+		har, err := newHARFile(*harFlag)
+		kingpin.FatalIfError(err, "")
+		rsClientInternal.RecordHAR(har)
+	}
+
 	return rsClientInternal
 }
 
 //===== Request Recording
 
+// MyRecording is the recording of one command in a cassette, see cassette.go
 type MyRecording struct {
-	CmdArgs  []string         // command line arguments
-	ExitCode int              // Exit code
-	Stdout   string           // Exit print
-	RR       RequestRecording // back-end request/response
+	CmdArgs      []string           // command line arguments
+	ExitCode     int                // Exit code
+	Stdout       string             // Exit print
+	Interactions []RequestRecording // back-end requests/responses in the order performed
+	RR           *RequestRecording  `json:",omitempty"` // single request of old recordings
 }
 
-var ReqResp MyRecording // global var, we only have one request in flight
+var ReqResp MyRecording // global var, we only record one command at a time
 
 //===== Main
 
@@ -161,12 +327,13 @@ var reResourceHref = regexp.MustCompile(`^([a-z0-9_]+)|(/(api|rll)(/[A-Za-z0-9_]
 func captureCmdArgs(args []string) []string {
 	rec := []string{}
 	skipArg := false // skip the next argument
-	for _, a := range os.Args[1:] {
+	for _, a := range args {
 		if skipArg {
 			skipArg = false
 			continue
 		}
-		if a == "--record" { // don't record the record flag & filename
+		// don't record the record/replay/har flags
+		if a == "--record" || a == "--replay" || a == "--har" {
 			skipArg = true
 			continue
 		}
@@ -183,11 +350,25 @@ func captureCmdArgs(args []string) []string {
 	return rec
 }
 
+// subcommands that don't perform an API request, each parses its own flags, they're dispatched
+// before kingpin sees the command line because the first positional arg is normally an action
+var subcommands = map[string]func(args []string){
+	"mock-server": mockServerCmd,
+	"fake-server": fakeServerCmd,
+	"scenario":    scenarioCmd,
+	"cassette":    cassetteCmd,
+}
+
 func main() {
 	//for i, a := range os.Args {
 	//	fmt.Fprintf(os.Stderr, "arg[%d]=%s\n", i, a)
 	//}
 
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		subcommands[os.Args[1]](os.Args[2:])
+		return
+	}
+
 	// record the command line before we mess it up
 	ReqResp.CmdArgs = captureCmdArgs(os.Args[1:])
 
@@ -195,9 +376,13 @@ func main() {
 	initKingpin()
 	_ = kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	// cancel any request in flight when we get interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// validate resource href
 	if *resourceHref == "self" {
-		rh := getSelfHref()
+		rh := getSelfHref(ctx)
 		resourceHref = &rh
 	} else {
 		m := reResourceHref.FindStringSubmatch(*resourceHref)
@@ -234,16 +419,115 @@ func main() {
 		xFlags += 1
 		selectExpr = *xj
 	}
-	if *xh != "" {
+	if *x0 != "" {
+		xFlags += 1
+		selectExpr = *x0
+	}
+	if *xpaths != "" {
+		xFlags += 1
+		selectExpr = *xpaths
+	}
+	if *xo != "" {
+		xFlags += 1
+		if _, err := parseRecordFields(*xo); err != nil {
+			kingpin.Fatalf("%s", err.Error())
+		}
+	}
+	if *query != "" {
+		xFlags += 1
+		selectExpr = *query
+		selectOne = *queryMode == "single"
+	}
+	if len(*xv) > 0 {
 		xFlags += 1
+		for _, a := range *xv {
+			if _, _, err := parseAssignment(a); err != nil {
+				kingpin.Fatalf("%s", err.Error())
+			}
+		}
+	} else if *exportFlag {
+		kingpin.Fatalf("--export requires --xv")
 	}
 	if xFlags > 1 {
-		kingpin.Fatalf("cannot specify --x1 and --xm at the same time")
+		kingpin.Fatalf("only one of --x1, --xm, --xj, --x0, --xo, --xpaths, --xv, and " +
+			"--query can be specified")
+	}
+	// headers and the status can be extracted along with values
+	if (len(*xv) > 0 || *xo != "") && (len(*xh) > 0 || *xs) {
+		kingpin.Fatalf("cannot combine --xv or --xo with --xh or --xs")
+	}
+	xFlags += len(*xh)
+	if *xs {
+		xFlags += 1
+	}
+	if *firstFlag && *lastFlag {
+		kingpin.Fatalf("only one of --first and --last can be specified")
+	}
+	if *rawFlag && (*xj != "" || *query != "" && *queryMode == "json") {
+		kingpin.Fatalf("--raw cannot be used to print a json array")
+	}
+	if xFlags > 0 && *formatFlag != "json" && (*xo == "" || *formatFlag == "yaml") {
+		kingpin.Fatalf("cannot extract values and use --format %s at the same time", *formatFlag)
 	}
+	if *templateFile != "" {
+		if *templateText != "" {
+			kingpin.Fatalf("cannot specify --template and --template-file at the same time")
+		}
+		t, err := ioutil.ReadFile(*templateFile)
+		kingpin.FatalIfError(err, "")
+		*templateText = string(t)
+	}
+	if *templateText != "" && (xFlags > 0 || *formatFlag != "json") {
+		kingpin.Fatalf("cannot use a template and extract values or use --format %s",
+			*formatFlag)
+	}
+
+	if *jsonlFlag {
+		if xFlags > 0 || *templateText != "" || *formatFlag != "json" {
+			kingpin.Fatalf("cannot use --jsonl to extract values, with a template, or "+
+				"with --format %s", *formatFlag)
+		}
+	}
+
+	method, uri, args := resolveRequest(*resourceHref, *actionName, *arguments)
+	if *dryRunFlag || *curlFlag {
+		dryRun(ctx, method, uri, args)
+		osExit(0)
+		return
+	}
+	resp, js := doRequest(ctx, method, uri, args, *jsonlFlag)
 
-	resp, js := doRequest(*resourceHref, *actionName, *arguments)
+	out := osStdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		kingpin.FatalIfError(err, "")
+		defer f.Close()
+		out = f
+	}
 
-	stdout, stderr, exit := doOutput(xFlags, selectOne, selectExpr, resp, js)
+	var stdout, stderr string
+	var exit int
+	if *jsonlFlag {
+		// print each resource as it's decoded, keeping a copy only when recording
+		var rec bytes.Buffer
+		w := out
+		if *recordFile != "" {
+			w = io.MultiWriter(out, &rec)
+		}
+		stderr, exit = printJSONLines(w, resp, js)
+		stdout, out = rec.String(), ioutil.Discard
+	} else if resp.body != nil && xFlags == 0 && *templateText == "" {
+		// binary response, stream it to stdout or the output file
+		_, err := io.Copy(out, resp.body)
+		resp.body.Close()
+		fatalIfError(err, "reading response")
+		stdout, out = string(resp.raw), ioutil.Discard // raw is only set when recording
+	} else {
+		if resp.body != nil {
+			resp.body.Close()
+		}
+		stdout, stderr, exit = doOutput(xFlags, selectOne, selectExpr, resp, js)
+	}
 
 	if *recordFile != "" {
 		ReqResp.Stdout = stdout
@@ -253,15 +537,36 @@ func main() {
 	}
 
 	fmt.Fprint(os.Stderr, stderr)
-	fmt.Fprint(osStdout, stdout)
+	fmt.Fprint(out, stdout)
 	osExit(exit)
 }
 
 func doOutput(xFlags int, selectOne bool, selectExpr string, resp *Response, js []byte) (string, string, int) {
 
+	if *templateText != "" {
+		// not extracting, print using the template
+		if resp.kind != bodyJSON {
+			return "", fmt.Sprintf("Cannot apply template to %s response", resp.kind), 1
+		}
+		stdout, err := renderTemplate(*templateText, resp.data)
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		return stdout, "", 0
+	}
+
+	if xFlags == 0 && resp.kind == bodyJSON && *formatFlag != "json" {
+		// not extracting, format as table, csv, etc.
+		stdout, err := formatResponse(*formatFlag, *columns, js, outputWidth())
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		return stdout, "", 0
+	}
+
 	if xFlags == 0 {
 		// not extracting, let's print the json pretty or not
-		if *prettyFlag {
+		if *prettyFlag && resp.kind == bodyJSON {
 			var buf bytes.Buffer
 			json.Indent(&buf, js, "", "  ")
 			js = buf.Bytes()
@@ -270,22 +575,234 @@ func doOutput(xFlags int, selectOne bool, selectExpr string, resp *Response, js
 		return string(js), "", 0
 	}
 
-	if *xh != "" {
-		// we're extracting a header
-		return resp.header.Get(*xh), "", 0
+	if len(*xh) > 0 || *xs {
+		// we're extracting headers or the status, possibly along with values
+		return printResponseParts(xFlags, selectOne, selectExpr, resp, js)
 	}
 
-	// let's extract something using json:select
-	parser, err := jsonselect.CreateParserFromString(string(js))
+	if resp.kind != bodyJSON {
+		return "", fmt.Sprintf("Cannot extract values from %s response", resp.kind), 1
+	}
+
+	if len(*xv) > 0 {
+		// we're extracting shell variable assignments
+		return printAssignments(*xv, js, *exportFlag)
+	}
+
+	if *xo != "" {
+		// we're extracting records
+		fields, _ := parseRecordFields(*xo)
+		records, err := extractRecords(fields, js)
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		if len(records) == 0 && *failEmpty {
+			return "", "No value could be selected", exitEmpty
+		}
+		return printRecords(fields, records, *formatFlag, outputWidth()), "", 0
+	}
+
+	// let's extract something using json:select or jmespath
+	values, err := extractValues(selectExpr, js)
 	if err != nil {
 		return "", err.Error(), 1
 	}
-	values, err := parser.GetValues(selectExpr)
+	if selectOne {
+		values = pickValue(values)
+	}
+	return printExtracted(values, selectOne, selectExpr, js)
+}
+
+// pickValue applies --default, --first, and --last to the values selected for --x1 or --xv
+func pickValue(values []interface{}) []interface{} {
+	switch {
+	case len(values) == 0 && defaultValue.set:
+		return []interface{}{defaultValue.value}
+	case len(values) > 1 && *firstFlag:
+		return values[:1]
+	case len(values) > 1 && *lastFlag:
+		return values[len(values)-1:]
+	}
+	return values
+}
+
+// printJSONLines writes one line per resource to w for --jsonl, streaming the response body
+// if it hasn't been read yet
+func printJSONLines(w io.Writer, resp *Response, js []byte) (string, int) {
+	r := io.Reader(bytes.NewReader(js))
+	if resp.body != nil {
+		defer resp.body.Close()
+		r = resp.body
+	}
+	if resp.kind != bodyJSON {
+		return fmt.Sprintf("Cannot print %s response as json lines", resp.kind), 1
+	}
+	if err := writeJSONLines(w, r); err != nil {
+		return fmt.Sprintf("Error printing json lines: %s", err.Error()), 1
+	}
+	return "", 0
+}
+
+// printExtracted prints the extracted values as requested by the flags, with --fail-empty
+// selecting no values is an error and with --explain a cardinality error for --x1 shows where
+// the candidate values are
+func printExtracted(values []interface{}, selectOne bool, selectExpr string, js []byte) (
+	string, string, int) {
+
+	if !selectOne && len(values) == 0 && *failEmpty {
+		return "", "No value could be selected", exitEmpty
+	}
+	if *xpaths != "" {
+		return printPaths(selectExpr, js, values)
+	}
+	stdout, stderr, exit := printValues(values, valuesMode(selectOne), *rawFlag)
+	if exit != 0 && selectOne && *explainFlag {
+		stderr += explainMatches(selectExpr, js, values)
+	}
+	return stdout, stderr, exit
+}
+
+// outputWidth returns the width tables should be truncated to, 0 if not printing to a terminal
+func outputWidth() int {
+	if *output == "" && osStdout == io.Writer(os.Stdout) {
+		return terminalWidth(os.Stdout)
+	}
+	return 0
+}
+
+// extractValues extracts values from the json using --query or json:select
+func extractValues(selectExpr string, js []byte) ([]interface{}, error) {
+	if *query != "" {
+		return queryValues(selectExpr, js)
+	}
+	return selectValues(selectExpr, js)
+}
+
+// valuesMode returns how printValues should print the extracted values given the flags
+func valuesMode(selectOne bool) string {
+	switch {
+	case selectOne:
+		return "single"
+	case *xj != "" || *query != "" && *queryMode == "json":
+		return "json"
+	case *x0 != "":
+		return "nul"
+	}
+	return "multi"
+}
+
+// printResponseParts prints the extracted status code (--xs), headers (--xh) and values. A
+// single --xs or --xh is printed on one line like --x1. When extracting more than one part the
+// lines format prints the status on the first line, followed by one line per header in the
+// order given (empty if the header is missing), followed by the values as they would be
+// printed on their own, terminated by a newline. The json format prints an object such as
+// {"status":201,"headers":{"location":"/api/deployments/1"},"values":["x"]} where headers
+// that are missing are null and status and values are only present when extracted.
+func printResponseParts(xFlags int, selectOne bool, selectExpr string, resp *Response,
+	js []byte) (string, string, int) {
+
+	parts := len(*xh)
+	if *xs {
+		parts += 1
+	}
+	if xFlags == 1 && *xs {
+		return strconv.Itoa(resp.statusCode), "", 0
+	} else if xFlags == 1 {
+		return headerValue(resp.header, (*xh)[0]), "", 0
+	}
+
+	var values []interface{}
+	if xFlags > parts {
+		// extracting values as well
+		if resp.kind != bodyJSON {
+			return "", fmt.Sprintf("Cannot extract values from %s response",
+				resp.kind), 1
+		}
+		var err error
+		values, err = extractValues(selectExpr, js)
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		if selectOne {
+			values = pickValue(values)
+		}
+		if selectOne && len(values) != 1 || len(values) == 0 && *failEmpty {
+			// let printExtracted produce the error
+			return printExtracted(values, selectOne, selectExpr, js)
+		}
+	}
+
+	if *xFormat == "json" {
+		res := map[string]interface{}{}
+		if *xs {
+			res["status"] = resp.statusCode
+		}
+		if len(*xh) > 0 {
+			headers := map[string]interface{}{}
+			for _, h := range *xh {
+				if _, ok := resp.header[http.CanonicalHeaderKey(h)]; ok {
+					headers[h] = headerValue(resp.header, h)
+				} else {
+					headers[h] = nil
+				}
+			}
+			res["headers"] = headers
+		}
+		if xFlags > parts {
+			if values == nil {
+				values = []interface{}{}
+			}
+			res["values"] = values
+		}
+		js, err := json.Marshal(res)
+		if err != nil {
+			return "", fmt.Sprintf("Error printing extracted values: %s", err.Error()), 1
+		}
+		return string(js) + "\n", "", 0
+	}
+
+	stdout := ""
+	if *xs {
+		stdout += strconv.Itoa(resp.statusCode) + "\n"
+	}
+	for _, h := range *xh {
+		stdout += headerValue(resp.header, h) + "\n"
+	}
+	if xFlags > parts {
+		mode := valuesMode(selectOne)
+		out, stderr, exit := printExtracted(values, selectOne, selectExpr, js)
+		if exit != 0 {
+			return "", stderr, exit
+		}
+		stdout += out
+		if mode == "single" || mode == "json" {
+			stdout += "\n"
+		}
+	}
+	return stdout, "", 0
+}
+
+// headerValue returns all the values of a header joined by commas, as they could have been
+// sent in a single header
+func headerValue(header http.Header, name string) string {
+	return strings.Join(header[http.CanonicalHeaderKey(name)], ", ")
+}
+
+// selectValues extracts values from the json using a json:select expression
+func selectValues(selectExpr string, js []byte) ([]interface{}, error) {
+	parser, err := jsonselect.CreateParserFromString(string(js))
 	if err != nil {
-		return "", err.Error(), 1
+		return nil, err
 	}
+	return parser.GetValues(selectExpr)
+}
 
-	if selectOne { // --x1 flag, really
+// printValues prints extracted values according to the mode: single requires exactly one value
+// and prints it as-is (--x1), json prints a json array (--xj), nul prints each value as-is
+// followed by a NUL character (--x0), and multi prints one json value per line (--xm), or the
+// strings as-is if raw is set
+func printValues(values []interface{}, mode string, raw bool) (string, string, int) {
+	if mode == "single" { // --x1 flag, really
 		if len(values) == 0 {
 			return "", fmt.Sprintf("No value could be selected"), 1
 			//return "", fmt.Sprintf("No value could be selected, result was: <<%s>>", js), 1
@@ -293,20 +810,12 @@ func doOutput(xFlags int, selectOne bool, selectExpr string, resp *Response, js
 			return "", fmt.Sprintf("Multiple values selected"), 1
 			//return "", fmt.Sprintf("Multiple values selected, result was: <<%s>>", js), 1
 		}
-		switch v := values[0].(type) {
-		case nil:
-			return "", "", 0
-		case bool, float64, string:
-			return fmt.Sprint(v), "", 0
-		default:
-			js, err := json.Marshal(v)
-			if err != nil {
-				return "", fmt.Sprintf("Error printing selected value: %s",
-					err.Error()), 1
-			}
-			return string(js), "", 0
+		str, err := valueString(values[0])
+		if err != nil {
+			return "", fmt.Sprintf("Error printing selected value: %s", err.Error()), 1
 		}
-	} else if *xj != "" { // --xj flag
+		return str, "", 0
+	} else if mode == "json" { // --xj flag
 		// print array of json values
 		js, err := json.Marshal(values)
 		if err != nil {
@@ -314,10 +823,26 @@ func doOutput(xFlags int, selectOne bool, selectExpr string, resp *Response, js
 				err.Error()), 1
 		}
 		return string(js), "", 0
+	} else if mode == "nul" { // --x0 flag
+		// print values terminated by NUL, there is no need to quote anything
+		stdout := ""
+		for _, v := range values {
+			str, err := valueString(v)
+			if err != nil {
+				return "", fmt.Sprintf("Error printing selected value: %s",
+					err.Error()), 1
+			}
+			stdout += str + "\x00"
+		}
+		return stdout, "", 0
 	} else { // --xm flag
 		// print one value per line
 		stdout := ""
 		for _, v := range values {
+			if s, ok := v.(string); ok && raw {
+				stdout += s + "\n"
+				continue
+			}
 			js, err := json.Marshal(v)
 			if err != nil {
 				return "", fmt.Sprintf("Error printing selected value: %s",
@@ -329,6 +854,71 @@ func doOutput(xFlags int, selectOne bool, selectExpr string, resp *Response, js
 	}
 }
 
+// valueString formats a single extracted value the way --x1 prints it: scalars as-is and
+// objects or arrays as json
+func valueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case bool, string, json.Number:
+		return fmt.Sprint(v), nil
+	case float64: // avoid exponent notation for large numbers, such as IDs
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		js, err := json.Marshal(v)
+		return string(js), err
+	}
+}
+
+//===== Shell variable assignments
+
+var reAssignment = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.+)$`)
+
+// parseAssignment splits a --xv NAME=<json:select> argument
+func parseAssignment(a string) (string, string, error) {
+	m := reAssignment.FindStringSubmatch(a)
+	if m == nil {
+		return "", "", fmt.Errorf("--xv '%s' is not of the form NAME=<json:select>", a)
+	}
+	return m[1], m[2], nil
+}
+
+// shellQuote quotes a string for bash and sh by enclosing it in single quotes, each single
+// quote within the string ends the quoting, adds an escaped quote, and starts quoting again
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// printAssignments extracts one value per --xv assignment and prints NAME='value' lines, or
+// export NAME='value' lines, that can be eval'ed. Each selection must produce exactly one
+// value, just like --x1.
+func printAssignments(assignments []string, js []byte, export bool) (string, string, int) {
+	stdout := ""
+	for _, a := range assignments {
+		name, expr, _ := parseAssignment(a)
+		values, err := selectValues(expr, js)
+		if err != nil {
+			return "", fmt.Sprintf("%s: %s", name, err.Error()), 1
+		}
+		values = pickValue(values)
+		if len(values) == 0 {
+			return "", fmt.Sprintf("%s: No value could be selected", name), 1
+		} else if len(values) > 1 {
+			return "", fmt.Sprintf("%s: Multiple values selected", name), 1
+		}
+		str, err := valueString(values[0])
+		if err != nil {
+			return "", fmt.Sprintf("%s: Error printing selected value: %s",
+				name, err.Error()), 1
+		}
+		if export {
+			stdout += "export "
+		}
+		stdout += name + "=" + shellQuote(str) + "\n"
+	}
+	return stdout, "", 0
+}
+
 //===== Perform a request
 
 var reArgument = regexp.MustCompile(`^([a-zA-Z0-9_\[\]]+)=(.*)`)
@@ -351,19 +941,22 @@ var exceptionActions = map[string][2]string{
 	"update_source":     [2]string{"/source", "PUT"},
 }
 
-// performs the request and returns a *Response and the parsed json, bombs on error
-func doRequest(resourceHref, actionName string, arguments []string) (*Response, []byte) {
+// resolveRequest figures out the http verb, the URI, and the escaped query string arguments of
+// an action on a resource, bombs on invalid arguments
+func resolveRequest(resourceHref, actionName string, arguments []string) (
+	string, string, []string) {
 
 	// query-string encode the arguments
 	// we don't use url.Values because we allow multiple arguments with the same
 	// key, filter[]=... is an example
 	// we don't encode the key part because it's not required by our servers
-	for i := range arguments {
-		s := reArgument.FindStringSubmatch(arguments[i])
+	args := append([]string(nil), arguments...)
+	for i := range args {
+		s := reArgument.FindStringSubmatch(args[i])
 		if len(s) != 3 {
-			kingpin.Fatalf("argument '%s' is not valid", arguments[i])
+			kingpin.Fatalf("argument '%s' is not valid", args[i])
 		}
-		arguments[i] = s[1] + "=" + url.QueryEscape(s[2])
+		args[i] = s[1] + "=" + url.QueryEscape(s[2])
 	}
 
 	// figure out the HTTP verb and exact URI, we have a table of CRUD actions, the rest
@@ -380,20 +973,37 @@ func doRequest(resourceHref, actionName string, arguments []string) (*Response,
 			resourceHref += "/" + actionName
 		}
 	}
+	// only the API has xml representations, RL10's own endpoints such as /rll/env don't
+	if accept != nil && *accept == "xml" && strings.HasPrefix(resourceHref, "/api/") {
+		resourceHref += ".xml"
+	}
+	return method, resourceHref, args
+}
+
+// performs the request and returns a *Response and the raw json, bombs on error, with stream
+// the body of a json response is left unread for printing it as it's received
+func doRequest(ctx context.Context, method, uri string, args []string, stream bool) (
+	*Response, []byte) {
 
 	// perform the request
-	resp, err := rightscale().Do(method, resourceHref, arguments, "", "")
+	var resp *Response
+	var err error
+	if stream {
+		resp, err = rightscale().DoStream(ctx, method, uri, args)
+	} else {
+		resp, err = rightscale().Do(ctx, method, uri, args, "", "")
+	}
 	if resp == nil {
-		kingpin.FatalIfError(err, "")
+		fatalIfError(err, "")
 	} else {
-		kingpin.FatalIfError(err, resp.errorMessage)
+		fatalIfError(err, resp.errorMessage)
 	}
 
-	// produce JSON
+	// pass the JSON through exactly as we got it so key order and numbers are preserved,
+	// text and xml are also printed verbatim
 	js := []byte("")
-	if resp.data != nil {
-		js, err = json.Marshal(resp.data)
-		kingpin.FatalIfError(err, "")
+	if resp.data != nil || resp.kind == bodyText || resp.kind == bodyXML {
+		js = resp.raw
 	}
 
 	return resp, js
@@ -424,14 +1034,14 @@ func findRel(rel string, data map[string]interface{}) string {
 
 // retrieve the instance's self href (e.g. /api/instances/123) either from RLL or from the
 // platform
-func getSelfHref() string {
+func getSelfHref(ctx context.Context) string {
 	if !*rl10Flag {
 		kingpin.Fatalf("Cannot retrieve self-href when not using RightLink proxy")
 	}
 
 	// first query RLL to see whether it has the self href as a global variable
-	resp, err := rightscale().Do("GET", "/rll/env", nil, "", "")
-	kingpin.FatalIfError(err, "fetching self_href")
+	resp, err := rightscale().Do(ctx, "GET", "/rll/env", nil, "", "")
+	fatalIfError(err, "fetching self_href")
 	jq := jsonq.NewQuery(resp.data)
 	href, err := jq.String("RS_SELF_HREF")
 	if err == nil && href != "" {
@@ -443,8 +1053,8 @@ func getSelfHref() string {
 	}
 
 	// RLL doesn't have it, fetch it from the platform
-	resp, err = rightscale().Do("GET", "/api/session/instance", nil, "", "")
-	kingpin.FatalIfError(err, "fetching instance from RS")
+	resp, err = rightscale().Do(ctx, "GET", "/api/session/instance", nil, "", "")
+	fatalIfError(err, "fetching instance from RS")
 	if data, ok := resp.data.(map[string]interface{}); ok {
 		href = findRel("self", data)
 	}
@@ -453,10 +1063,13 @@ func getSelfHref() string {
 		kingpin.Fatalf("extracting self-href from %+v <<%s>>", resp.data, resp.raw)
 	}
 
-	// set the self-href as global in RLL
-	_, err = rightscale().Do("PUT", "/rll/env/RS_SELF_HREF", nil, "text/plain", href)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: cannot set RS_SELF_HREF in RLL: %s\n", err.Error())
+	// set the self-href as global in RLL, unless this is a dry run that must not change anything
+	if !*dryRunFlag && !*curlFlag {
+		_, err = rightscale().Do(ctx, "PUT", "/rll/env/RS_SELF_HREF", nil, "text/plain", href)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot set RS_SELF_HREF in RLL: %s\n",
+				err.Error())
+		}
 	}
 
 	if *debugFlag {
@@ -467,8 +1080,11 @@ func getSelfHref() string {
 
 //===== Recording helpers
 
+// secrets to hide in recordings and debug output, set up by rightscale()
+var redaction *redactor
+
 func recorder(rr RequestRecording) {
-	// remove some headers for security purposes and others to reduce recording bulk
+	// remove some headers that would only be redacted anyway and others to reduce recording bulk
 	rr.ReqHeader.Del("Authorization")
 	rr.ReqHeader.Del("User-Agent")
 	rr.RespHeader.Del("Cache-Control")
@@ -476,15 +1092,15 @@ func recorder(rr RequestRecording) {
 	rr.RespHeader.Del("Set-Cookie")
 	rr.RespHeader.Del("Strict-Transport-Security")
 	rr.RespHeader.Del("X-Request-Uuid")
-	ReqResp.RR = rr
+	ReqResp.Interactions = append(ReqResp.Interactions, redaction.recording(rr))
 }
 
 func recordToFile(filename string, r MyRecording) {
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	kingpin.FatalIfError(err, "")
 	defer f.Close()
-	json, _ := json.MarshalIndent(r, "", "  ")
-	fmt.Fprintf(f, "\n%s\n", json)
+	err = encodeRecording(f, r)
+	kingpin.FatalIfError(err, "")
 }
 
 /*
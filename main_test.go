@@ -0,0 +1,244 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// parseFlags initializes the command line flags the way main() does so doOutput & co can be
+// called directly
+func parseFlags(args ...string) {
+	initKingpin()
+	_, err := app.Parse(append(args, "show", "/api/clouds/1"))
+	Ω(err).ShouldNot(HaveOccurred())
+}
+
+var _ = Describe("Output", func() {
+
+	js := []byte(`{"name":"x","id":12345678901,"links":[],"actions":[{"rel":"a"}]}`)
+
+	It("prints the raw json", func() {
+		parseFlags()
+		stdout, _, exit := doOutput(0, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal(string(js)))
+	})
+
+	It("pretty-prints the raw json preserving key order", func() {
+		parseFlags("--pretty")
+		stdout, _, _ := doOutput(0, false, "", &Response{}, js)
+		Ω(stdout).Should(HavePrefix("{\n  \"name\": \"x\",\n  \"id\": 12345678901,\n"))
+	})
+
+	It("extracts large integers without loss", func() {
+		parseFlags("--x1", ".id")
+		stdout, _, exit := doOutput(1, true, ".id", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("12345678901"))
+	})
+
+})
+
+var _ = Describe("Output formats and files", func() {
+
+	It("formats the response whatever the output file is called", func() {
+		parseFlags("--format", "csv", "--output", "csv")
+		stdout, _, exit := doOutput(0, false, "", &Response{}, []byte(`[{"name":"a"}]`))
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("name\na\n"))
+		Ω(*output).Should(Equal("csv"))
+	})
+
+	It("rejects unknown formats instead of writing to a file", func() {
+		initKingpin()
+		_, err := app.Parse([]string{"--format", "tabel", "show", "/api/clouds/1"})
+		Ω(err).Should(HaveOccurred())
+	})
+
+})
+
+var _ = Describe("Non-JSON output", func() {
+
+	text := []byte("#!/bin/bash\necho hello\n")
+
+	It("prints text verbatim, even with --pretty", func() {
+		parseFlags("--pretty")
+		stdout, _, exit := doOutput(0, false, "", &Response{kind: bodyText}, text)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal(string(text)))
+	})
+
+	It("refuses to extract from text", func() {
+		parseFlags("--x1", ".name")
+		_, stderr, exit := doOutput(1, true, ".name", &Response{kind: bodyText}, text)
+		Ω(exit).Should(Equal(1))
+		Ω(stderr).Should(ContainSubstring("text response"))
+	})
+
+})
+
+var _ = Describe("JMESPath queries", func() {
+
+	js := []byte(`[{"name":"a","cloud_type":"amazon","id":1234500000},
+		{"name":"b","cloud_type":"azure","id":2},{"name":"c","cloud_type":"amazon","id":3}]`)
+
+	It("prints multiple values one per line", func() {
+		parseFlags("--query", "[?cloud_type=='amazon'].name")
+		stdout, _, exit := doOutput(1, false, *query, &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("\"a\"\n\"c\"\n"))
+	})
+
+	It("prints a single value", func() {
+		parseFlags("--query", "[0].id", "--query-mode", "single")
+		stdout, _, exit := doOutput(1, true, *query, &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("1234500000"))
+	})
+
+	It("enforces cardinality in single mode", func() {
+		parseFlags("--query", "[].name", "--query-mode", "single")
+		_, stderr, exit := doOutput(1, true, *query, &Response{}, js)
+		Ω(exit).Should(Equal(1))
+		Ω(stderr).Should(Equal("Multiple values selected"))
+	})
+
+	It("builds new objects", func() {
+		parseFlags("--query", "[?id > `2`].{n: name, t: cloud_type}", "--query-mode", "json")
+		stdout, _, exit := doOutput(1, false, *query, &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal(`[{"n":"a","t":"amazon"},{"n":"c","t":"amazon"}]`))
+	})
+
+})
+
+var _ = Describe("Shell variable assignments", func() {
+
+	js := []byte(`{"name":"it's a \"test\"","id":12345678901,"tags":["a","b"],
+		"links":[{"rel":"self","href":"/api/servers/1"}]}`)
+
+	It("prints quoted assignments", func() {
+		parseFlags("--xv", "NAME=.name", "--xv", "ID=.id",
+			"--xv", `HREF=object:has(.rel:val("self")).href`)
+		stdout, _, exit := doOutput(1, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("NAME='it'\\''s a \"test\"'\nID='12345678901'\n" +
+			"HREF='/api/servers/1'\n"))
+	})
+
+	It("prints export statements", func() {
+		parseFlags("--xv", "TAGS=.tags", "--export")
+		stdout, _, exit := doOutput(1, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("export TAGS='[\"a\",\"b\"]'\n"))
+	})
+
+	It("requires exactly one value per variable", func() {
+		parseFlags("--xv", "NAME=.name", "--xv", "TAG=.tags string")
+		_, stderr, exit := doOutput(1, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(1))
+		Ω(stderr).Should(Equal("TAG: Multiple values selected"))
+	})
+
+	It("rejects invalid variable names", func() {
+		_, _, err := parseAssignment("1X=.name")
+		Ω(err).Should(HaveOccurred())
+	})
+
+})
+
+var _ = Describe("Header and status extraction", func() {
+
+	js := []byte(`{"name":"dep","links":[{"rel":"self","href":"/api/deployments/1"}]}`)
+	resp := &Response{statusCode: 201, header: http.Header{
+		"Location": {"/api/deployments/1"}, "Content-Type": {"application/json"},
+		"Vary": {"Accept", "Accept-Encoding"}}}
+
+	It("prints the status on its own", func() {
+		parseFlags("--xs")
+		stdout, _, exit := doOutput(1, false, "", resp, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("201"))
+	})
+
+	It("prints the status, headers, and values on separate lines", func() {
+		parseFlags("--xs", "--xh", "location", "--xh", "x-missing", "--x1", ".name")
+		stdout, _, exit := doOutput(4, true, ".name", resp, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("201\n/api/deployments/1\n\ndep\n"))
+	})
+
+	It("prints all the values of a header", func() {
+		parseFlags("--xh", "vary")
+		stdout, _, _ := doOutput(1, false, "", resp, js)
+		Ω(stdout).Should(Equal("Accept, Accept-Encoding"))
+		parseFlags("--xs", "--xh", "vary")
+		stdout, _, _ = doOutput(2, false, "", resp, js)
+		Ω(stdout).Should(Equal("201\nAccept, Accept-Encoding\n"))
+	})
+
+	It("prints the status, headers, and values as json", func() {
+		parseFlags("--xs", "--xh", "Location", "--xh", "x-missing", "--xh", "vary", "--xm",
+			".name", "--extract-format", "json")
+		stdout, _, exit := doOutput(5, false, ".name", resp, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(MatchJSON(`{"status":201,"values":["dep"], "headers":{
+			"Location":"/api/deployments/1","x-missing":null,"vary":"Accept, Accept-Encoding"}}`))
+	})
+
+	It("enforces cardinality of --x1", func() {
+		parseFlags("--xs", "--x1", ".nothing")
+		_, stderr, exit := doOutput(2, true, ".nothing", resp, js)
+		Ω(exit).Should(Equal(1))
+		Ω(stderr).Should(Equal("No value could be selected"))
+	})
+
+})
+
+var _ = Describe("Cardinality controls", func() {
+
+	js := []byte(`[{"name":"a","tags":[]},{"name":"b","tags":[]}]`)
+
+	It("prints the default when nothing is selected", func() {
+		parseFlags("--x1", ".missing", "--default", "none")
+		stdout, _, exit := doOutput(1, true, ".missing", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("none"))
+	})
+
+	It("accepts an empty default", func() {
+		parseFlags("--xv", "X=.missing", "--default", "")
+		stdout, _, exit := doOutput(1, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("X=''\n"))
+	})
+
+	It("picks the first or last value", func() {
+		parseFlags("--x1", ".name", "--first")
+		stdout, _, exit := doOutput(1, true, ".name", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("a"))
+
+		parseFlags("--x1", ".name", "--last")
+		stdout, _, exit = doOutput(1, true, ".name", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("b"))
+	})
+
+	It("fails on empty results with --fail-empty", func() {
+		parseFlags("--xm", ".tags string", "--fail-empty")
+		_, stderr, exit := doOutput(1, false, ".tags string", &Response{}, js)
+		Ω(exit).Should(Equal(exitEmpty))
+		Ω(stderr).Should(Equal("No value could be selected"))
+
+		parseFlags("--xj", ".tags string")
+		stdout, _, exit := doOutput(1, false, ".tags string", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("[]"))
+	})
+
+})
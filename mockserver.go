@@ -0,0 +1,91 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Mock API server
+
+// rs-api mock-server serves the interactions recorded in a cassette over HTTP so other tools
+// can be developed and tested offline against realistic responses. It impersonates both the
+// RightScale API and the RL10 proxy: requests are answered just like --replay does it (see
+// replay.go), credentials are not checked, and an /api/oauth2 request that has no recorded
+// interaction gets a made-up access token so clients using an API key can authenticate.
+// It only speaks plain http, direct clients reach it using an explicit http:// host.
+// Example: rs-api mock-server --cassette recording.json --listen :8080, then
+// rs-api --rl10 --host localhost:8080 --key x index clouds, or
+// rs-api --host http://localhost:8080 --key x index clouds
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+// response to oauth2 requests that were not recorded
+const mockOAuthResponse = `{"access_token":"mock-access-token","expires_in":7200,` +
+	`"token_type":"bearer"}`
+
+// mockServerCmd implements the mock-server subcommand
+func mockServerCmd(args []string) {
+	cmd := kingpin.New("rs-api mock-server", `Serve the interactions recorded in a cassette
+
+rs-api mock-server impersonates the RightScale API and the RightLink10 proxy by answering
+requests with the matching responses recorded in a cassette using rs-api --record.
+`)
+	cassette := cmd.Flag("cassette", "cassette file with the recorded interactions").
+		Required().String()
+	listen := cmd.Flag("listen", "address to listen on, ex: :8080 or localhost:8080").
+		Default(":8080").String()
+	_ = kingpin.MustParse(cmd.Parse(args))
+
+	recs, err := readCassette(*cassette)
+	kingpin.FatalIfError(err, "")
+	var interactions []RequestRecording
+	for _, r := range recs {
+		interactions = append(interactions, r.Interactions...)
+	}
+
+	fmt.Fprintf(os.Stderr, "rs-api mock-server: serving %d interactions on %s\n",
+		len(interactions), *listen)
+	err = http.ListenAndServe(*listen, newMockServer(interactions, os.Stderr))
+	kingpin.FatalIfError(err, "")
+}
+
+// mockServer is the http.Handler of the mock server
+type mockServer struct {
+	replay *replayTransport
+	log    io.Writer // where each request is logged
+}
+
+// newMockServer creates a mock server handler answering requests from the interactions
+func newMockServer(interactions []RequestRecording, log io.Writer) *mockServer {
+	return &mockServer{replay: newReplayTransport(interactions), log: log}
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	uri := defaultRedactor.uri(req.URL.RequestURI()) // don't log the api key
+	resp, err := s.replay.RoundTrip(req)
+	switch {
+	case err == nil:
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length") // the recorded body may have been altered
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/api/oauth2"):
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, mockOAuthResponse)
+		fmt.Fprintf(s.log, "%s %s: made-up access token\n", req.Method, uri)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		fmt.Fprintf(s.log, "%s %s: NO MATCHING INTERACTION\n", req.Method, uri)
+		return
+	}
+	fmt.Fprintf(s.log, "%s %s: %d\n", req.Method, uri, resp.StatusCode)
+}
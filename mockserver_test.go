@@ -0,0 +1,78 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mock server", func() {
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	interactions := []RequestRecording{
+		{Verb: "GET", Uri: "https://us-3.rightscale.com/api/clouds/6", Status: 200,
+			RespHeader: jsonHeader, RespBody: `{"name":"EC2 us-west-2"}`},
+		{Verb: "GET", Uri: "http://localhost:1234/rll/env", Status: 200,
+			RespHeader: jsonHeader, RespBody: `{"RS_SELF_HREF":"/api/clouds/1/instances/1"}`},
+	}
+
+	var log bytes.Buffer
+
+	BeforeEach(func() {
+		log.Reset()
+	})
+
+	It("impersonates the API, including authentication", func() {
+		server := httptest.NewTLSServer(newMockServer(interactions, &log))
+		defer server.Close()
+
+		c, _ := NewDirectClient(strings.TrimPrefix(server.URL, "https://"), "some-key", false)
+		c.SetInsecure()
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds/6", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(resp.raw)).Should(Equal(`{"name":"EC2 us-west-2"}`))
+		Ω(log.String()).Should(Equal("" +
+			"POST /api/oauth2?grant_type=refresh_token&refresh_token=REDACTED: made-up access token\n" +
+			"GET /api/clouds/6: 200\n"))
+	})
+
+	It("serves direct clients over plain http", func() {
+		server := httptest.NewServer(newMockServer(interactions, &log))
+		defer server.Close()
+
+		c, _ := NewDirectClient(server.URL, "some-key", false)
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds/6", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(resp.raw)).Should(Equal(`{"name":"EC2 us-west-2"}`))
+		Ω(log.String()).ShouldNot(ContainSubstring("some-key"))
+	})
+
+	It("impersonates the RL10 proxy", func() {
+		server := httptest.NewServer(newMockServer(interactions, &log))
+		defer server.Close()
+
+		c, _ := NewProxyClient(strings.TrimPrefix(server.URL, "http://"), "secret", false)
+		resp, err := c.Do(context.Background(), "GET", "/rll/env", nil, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.data).Should(HaveKeyWithValue("RS_SELF_HREF", "/api/clouds/1/instances/1"))
+	})
+
+	It("fails requests that were not recorded", func() {
+		server := httptest.NewServer(newMockServer(interactions, &log))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/api/clouds/7")
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Ω(resp.StatusCode).Should(Equal(http.StatusNotImplemented))
+		Ω(log.String()).Should(Equal("GET /api/clouds/7: NO MATCHING INTERACTION\n"))
+	})
+
+})
@@ -0,0 +1,543 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Output formats
+
+// In addition to printing json, responses can be formatted as table, csv, tsv, or yaml. Tables
+// and csv/tsv have one row per resource, so a collection produces many rows and a single
+// resource produces one row. The columns default to all the scalar fields of the resources
+// followed by one column per link rel (the value being the link's href), alternatively the
+// columns can be specified explicitly using simple paths such as name, settings.size, or
+// public_ip_addresses[0].
+// Key order is preserved everywhere by decoding the raw json into objects that are lists of
+// fields instead of maps.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// field is a key/value pair of a json object
+type field struct {
+	key   string
+	value interface{}
+}
+
+// object is a json object decoded with the key order preserved
+type object []field
+
+// get returns the value of the named field
+func (o object) get(key string) (interface{}, bool) {
+	for _, f := range o {
+		if f.key == key {
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+// decodeOrdered decodes json such that objects become object, arrays become []interface{},
+// and numbers become json.Number
+func decodeOrdered(js []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	return decodeOrderedValue(dec)
+}
+
+func decodeOrderedValue(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, field{k.(string), v})
+		}
+		_, err = dec.Token() // closing brace
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			v, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = dec.Token() // closing bracket
+		return arr, err
+	default:
+		return t, nil
+	}
+}
+
+// formatResponse formats the json response according to the format, which is one of the
+// --format values other than json, columns is a comma-separated list of column paths for
+// table, csv, and tsv
+func formatResponse(format, columns string, js []byte, termWidth int) (string, error) {
+	if len(bytes.TrimSpace(js)) == 0 {
+		return "", nil
+	}
+	data, err := decodeOrdered(js)
+	if err != nil {
+		return "", fmt.Errorf("error decoding json: %s", err.Error())
+	}
+
+	if format == "yaml" {
+		var buf bytes.Buffer
+		writeYAML(&buf, data, 0)
+		return buf.String(), nil
+	}
+
+	// collect the rows, auto-detecting collections vs single resources
+	var rows []object
+	switch d := data.(type) {
+	case object:
+		rows = []object{d}
+	case []interface{}:
+		for _, e := range d {
+			o, ok := e.(object)
+			if !ok {
+				return "", fmt.Errorf("cannot format a collection of %s as %s",
+					jsonType(e), format)
+			}
+			rows = append(rows, o)
+		}
+	default:
+		return "", fmt.Errorf("cannot format a %s as %s", jsonType(data), format)
+	}
+
+	var cols []string
+	if columns != "" {
+		cols = strings.Split(columns, ",")
+	} else {
+		cols = defaultColumns(rows)
+	}
+	paths := make([][]interface{}, len(cols))
+	for i, c := range cols {
+		if paths[i], err = parseColumn(c); err != nil {
+			return "", err
+		}
+	}
+
+	cells := make([][]string, len(rows))
+	for r, row := range rows {
+		cells[r] = make([]string, len(cols))
+		for c := range cols {
+			cells[r][c] = formatCell(lookupColumn(row, paths[c]))
+		}
+	}
+
+	return formatRows(format, cols, cells, termWidth), nil
+}
+
+// writeJSONLines writes each element of a json array on its own line as soon as it has been
+// decoded, so large collections don't need to be held in memory; a single resource produces a
+// single line. Key order and numbers are preserved.
+func writeJSONLines(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return nil // empty body
+		} else if err != nil {
+			return err
+		}
+		if !unicode.IsSpace(rune(c)) {
+			br.UnreadByte()
+			break
+		}
+	}
+
+	dec := json.NewDecoder(br)
+	var buf bytes.Buffer
+	writeLine := func() error {
+		var elem json.RawMessage
+		if err := dec.Decode(&elem); err != nil {
+			return err
+		}
+		buf.Reset()
+		if err := json.Compact(&buf, elem); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	if b, _ := br.Peek(1); b[0] != '[' {
+		return writeLine()
+	}
+	if _, err := dec.Token(); err != nil { // opening bracket
+		return err
+	}
+	for dec.More() {
+		if err := writeLine(); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token() // closing bracket
+	return err
+}
+
+// formatRows formats the cells as a table, csv, or tsv with a header row of column names
+func formatRows(format string, cols []string, cells [][]string, termWidth int) string {
+	var buf bytes.Buffer
+	switch format {
+	case "csv":
+		w := csv.NewWriter(&buf)
+		w.Write(cols)
+		w.WriteAll(cells)
+	case "tsv":
+		writeTSV(&buf, cols, cells)
+	default:
+		writeTable(&buf, cols, cells, termWidth)
+	}
+	return buf.String()
+}
+
+// defaultColumns returns the scalar fields of all rows in order of first appearance followed by
+// the link rels
+func defaultColumns(rows []object) []string {
+	cols := []string{}
+	seen := map[string]bool{}
+	add := func(c string) {
+		if !seen[c] {
+			seen[c] = true
+			cols = append(cols, c)
+		}
+	}
+	for _, row := range rows {
+		for _, f := range row {
+			switch f.value.(type) {
+			case object, []interface{}:
+			default:
+				add(f.key)
+			}
+		}
+	}
+	for _, row := range rows {
+		for _, l := range links(row) {
+			add(l.key)
+		}
+	}
+	return cols
+}
+
+// links returns the rel/href pairs in the links array of a resource
+func links(row object) []field {
+	ll, _ := row.get("links")
+	arr, _ := ll.([]interface{})
+	res := []field{}
+	for _, l := range arr {
+		if o, ok := l.(object); ok {
+			rel, _ := o.get("rel")
+			href, _ := o.get("href")
+			if r, ok := rel.(string); ok {
+				res = append(res, field{r, href})
+			}
+		}
+	}
+	return res
+}
+
+var reColumnPart = regexp.MustCompile(`^([^.\[\]]+)|^\.([^.\[\]]+)|^\[(\d+)\]`)
+
+// parseColumn parses a column path such as a.b[0].c into a list of string keys and int
+// indexes
+func parseColumn(col string) ([]interface{}, error) {
+	path := []interface{}{}
+	for rest := strings.TrimSpace(col); rest != ""; {
+		m := reColumnPart.FindStringSubmatch(rest)
+		if m == nil || len(path) == 0 && m[1] == "" || len(path) > 0 && m[1] != "" {
+			return nil, fmt.Errorf("invalid column '%s'", col)
+		}
+		switch {
+		case m[1] != "":
+			path = append(path, m[1])
+		case m[2] != "":
+			path = append(path, m[2])
+		default:
+			i, _ := strconv.Atoi(m[3])
+			path = append(path, i)
+		}
+		rest = rest[len(m[0]):]
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty column name")
+	}
+	return path, nil
+}
+
+// lookupColumn follows the column path in the row, a single-element path that doesn't name a
+// field can name a link rel instead
+func lookupColumn(row object, path []interface{}) interface{} {
+	var v interface{} = row
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			o, ok := v.(object)
+			if !ok {
+				return nil
+			}
+			if v, ok = o.get(k); !ok {
+				if len(path) == 1 {
+					v, _ = object(links(row)).get(k)
+				}
+				return v
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || k >= len(arr) {
+				return nil
+			}
+			v = arr[k]
+		}
+	}
+	return v
+}
+
+// formatCell produces the text for a table cell, arrays of scalars are comma-separated and
+// anything else that is not a scalar is printed as json
+func formatCell(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	case []interface{}:
+		parts := make([]string, len(t))
+		for i, e := range t {
+			switch e.(type) {
+			case object, []interface{}:
+				return compactJSON(v)
+			}
+			parts[i] = formatCell(e)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return compactJSON(v)
+	}
+}
+
+// writeTSV writes tab-separated values, tabs and newlines in values are escaped
+func writeTSV(w io.Writer, cols []string, cells [][]string) {
+	esc := strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+	for _, row := range append([][]string{cols}, cells...) {
+		for i, c := range row {
+			row[i] = esc.Replace(c)
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+}
+
+// writeTable writes an aligned table, if width is non-zero the widest columns are truncated
+// so the table fits
+func writeTable(w io.Writer, cols []string, cells [][]string, width int) {
+	const sep = "  "
+	const minWidth = 8 // don't truncate columns to less than this
+	rows := append([][]string{cols}, cells...)
+	widths := make([]int, len(cols))
+	for _, row := range rows {
+		for i, c := range row {
+			c = strings.Replace(c, "\n", " ", -1)
+			row[i] = c
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	if width > 0 {
+		total := len(sep) * (len(cols) - 1)
+		for _, w := range widths {
+			total += w
+		}
+		for total > width {
+			widest := 0
+			for i := range widths {
+				if widths[i] > widths[widest] {
+					widest = i
+				}
+			}
+			if widths[widest] <= minWidth {
+				break
+			}
+			widths[widest]--
+			total--
+		}
+	}
+
+	for _, row := range rows {
+		line := ""
+		for i, c := range row {
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				c = string([]rune(c)[:widths[i]-1]) + "…"
+			}
+			if i < len(row)-1 {
+				c += strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c)) + sep
+			}
+			line += c
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
+
+var reYAMLPlain = regexp.MustCompile(`^[A-Za-z_/][-A-Za-z0-9_ ./()]*$`)
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "null": true, "yes": true, "no": true, "on": true,
+	"off": true, "y": true, "n": true, "~": true,
+}
+
+// yamlString returns s as a plain yaml scalar if that's unambiguous, else double-quoted
+func yamlString(s string) string {
+	if reYAMLPlain.MatchString(s) && !yamlReserved[strings.ToLower(s)] &&
+		!strings.HasSuffix(s, " ") {
+		return s
+	}
+	return compactJSON(s) // json strings are valid yaml double-quoted scalars
+}
+
+// writeYAML writes v as a block-style yaml document at the given indentation level
+func writeYAML(w io.Writer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch t := v.(type) {
+	case object:
+		if len(t) == 0 {
+			fmt.Fprintf(w, "%s{}\n", pad)
+		}
+		for _, f := range t {
+			fmt.Fprintf(w, "%s%s:", pad, yamlString(f.key))
+			writeYAMLValue(w, f.value, indent+1)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			fmt.Fprintf(w, "%s[]\n", pad)
+		}
+		for _, e := range t {
+			fmt.Fprintf(w, "%s-", pad)
+			if o, ok := e.(object); ok && len(o) > 0 {
+				// first field goes on the same line as the dash
+				var buf bytes.Buffer
+				writeYAML(&buf, o, indent+1)
+				fmt.Fprintf(w, " %s", strings.TrimLeft(buf.String(), " "))
+			} else {
+				writeYAMLValue(w, e, indent+1)
+			}
+		}
+	default:
+		fmt.Fprintf(w, "%s%s\n", pad, yamlScalar(v))
+	}
+}
+
+// writeYAMLValue writes the value that follows a "key:" or "-"
+func writeYAMLValue(w io.Writer, v interface{}, indent int) {
+	switch t := v.(type) {
+	case object:
+		if len(t) == 0 {
+			fmt.Fprintln(w, " {}")
+			return
+		}
+		fmt.Fprintln(w)
+		writeYAML(w, v, indent)
+	case []interface{}:
+		if len(t) == 0 {
+			fmt.Fprintln(w, " []")
+			return
+		}
+		fmt.Fprintln(w)
+		writeYAML(w, v, indent)
+	default:
+		fmt.Fprintf(w, " %s\n", yamlScalar(v))
+	}
+}
+
+// yamlScalar formats a json scalar as yaml
+func yamlScalar(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return yamlString(t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// jsonType returns the name of the json type of a value, for error messages
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case object, map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// compactJSON marshals v, which may contain objects, into a json string
+func compactJSON(v interface{}) string {
+	var buf bytes.Buffer
+	writeJSON(&buf, v)
+	return buf.String()
+}
+
+// writeJSON is json.Marshal for values that may contain objects
+func writeJSON(w *bytes.Buffer, v interface{}) {
+	switch t := v.(type) {
+	case object:
+		w.WriteByte('{')
+		for i, f := range t {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeJSON(w, f.key)
+			w.WriteByte(':')
+			writeJSON(w, f.value)
+		}
+		w.WriteByte('}')
+	case []interface{}:
+		w.WriteByte('[')
+		for i, e := range t {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeJSON(w, e)
+		}
+		w.WriteByte(']')
+	default:
+		js, _ := json.Marshal(t)
+		w.Write(js)
+	}
+}
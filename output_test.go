@@ -0,0 +1,102 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output formats", func() {
+
+	collection := []byte(`[
+	  {"name":"web 1","state":"operational","public_ip_addresses":["1.2.3.4","5.6.7.8"],
+	   "links":[{"rel":"self","href":"/api/servers/1"},{"rel":"deployment","href":"/api/deployments/9"}]},
+	  {"name":"db, main","state":"stopped","public_ip_addresses":[],
+	   "links":[{"rel":"self","href":"/api/servers/2"}]}
+	]`)
+
+	It("formats a collection as a table with default columns", func() {
+		out, err := formatResponse("table", "", collection, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("" +
+			"name      state        self            deployment\n" +
+			"web 1     operational  /api/servers/1  /api/deployments/9\n" +
+			"db, main  stopped      /api/servers/2\n"))
+	})
+
+	It("formats selected columns as csv", func() {
+		out, err := formatResponse("csv", "name,public_ip_addresses[0],self", collection, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("" +
+			"name,public_ip_addresses[0],self\n" +
+			"web 1,1.2.3.4,/api/servers/1\n" +
+			"\"db, main\",,/api/servers/2\n"))
+	})
+
+	It("formats a single resource as tsv", func() {
+		out, err := formatResponse("tsv", "name,public_ip_addresses",
+			[]byte(`{"name":"a\tb","public_ip_addresses":["1.2.3.4","5.6.7.8"]}`), 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("name\tpublic_ip_addresses\na\\tb\t1.2.3.4,5.6.7.8\n"))
+	})
+
+	It("truncates tables to the terminal width", func() {
+		out, err := formatResponse("table", "name,self", collection, 20)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("" +
+			"name      self\n" +
+			"web 1     /api/serv…\n" +
+			"db, main  /api/serv…\n"))
+	})
+
+	It("formats yaml preserving key order", func() {
+		out, err := formatResponse("yaml", "",
+			[]byte(`{"name":"web","id":12345678901,"tags":[],"on":true,"links":[{"rel":"self","href":"/api/servers/1"}]}`), 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("" +
+			"name: web\n" +
+			"id: 12345678901\n" +
+			"tags: []\n" +
+			"\"on\": true\n" +
+			"links:\n" +
+			"  - rel: self\n" +
+			"    href: /api/servers/1\n"))
+	})
+
+	It("rejects invalid columns", func() {
+		_, err := formatResponse("table", "name,[0]", collection, 0)
+		Ω(err).Should(HaveOccurred())
+	})
+
+})
+
+var _ = Describe("JSON lines", func() {
+
+	It("prints one line per element", func() {
+		var buf bytes.Buffer
+		err := writeJSONLines(&buf, strings.NewReader(
+			"\n [ {\"b\": 1, \"a\": 12345678901234567890},\n {\"x\": [1, 2]} ]\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(buf.String()).Should(Equal(
+			"{\"b\":1,\"a\":12345678901234567890}\n{\"x\":[1,2]}\n"))
+	})
+
+	It("prints a single resource on one line", func() {
+		var buf bytes.Buffer
+		err := writeJSONLines(&buf, strings.NewReader(`{"name": "x"}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(buf.String()).Should(Equal("{\"name\":\"x\"}\n"))
+	})
+
+	It("reports truncated responses", func() {
+		var buf bytes.Buffer
+		err := writeJSONLines(&buf, strings.NewReader(`[{"name": "x"}, {"na`))
+		Ω(err).Should(HaveOccurred())
+		Ω(buf.String()).Should(Equal("{\"name\":\"x\"}\n"))
+	})
+
+})
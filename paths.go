@@ -0,0 +1,254 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Match paths
+
+// JSON:select returns the values matched by an expression but not where in the document they
+// are, which makes it hard to figure out why an expression matches too much or nothing at
+// all. To show where matches come from the document is walked and each matched value is
+// located by comparing it with the nodes of the document, preferring nodes with the key the
+// expression ends with, if any. Identical values are assigned to nodes in document order when
+// there are as many nodes as values, otherwise the value could come from any of the nodes and
+// all their paths are listed, e.g. "/0/v or /1/v". Paths are printed as JSON pointers
+// (RFC 6901), e.g. /0/links/0/href, the empty pointer being the whole document.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// max number of candidate paths listed by --explain
+const maxExplained = 20
+
+// node is a value in the document along with its location
+type node struct {
+	path  string      // json pointer
+	key   string      // key in the parent object, "" for array elements and the root
+	value interface{} // decoded using decodeOrdered
+	canon string      // canonical json used to compare values
+}
+
+// match is a value matched by an expression along with its location, path is "?" if the
+// value could not be located in the document
+type match struct {
+	path  string
+	value string // json
+}
+
+// the key an expression ends with, e.g. .name or ."name" but not .name:val("x")
+var reLastKey = regexp.MustCompile(`\.(?:([A-Za-z_][A-Za-z0-9_-]*)|"((?:[^"\\]|\\.)*)")\s*$`)
+
+// lastKey returns the key the expression ends with or ""
+func lastKey(selectExpr string) string {
+	m := reLastKey.FindStringSubmatch(selectExpr)
+	switch {
+	case m == nil:
+		return ""
+	case m[1] != "":
+		return m[1]
+	default:
+		k, err := strconv.Unquote(`"` + m[2] + `"`)
+		if err != nil {
+			return m[2]
+		}
+		return k
+	}
+}
+
+// pointerToken escapes a key for use in a json pointer
+func pointerToken(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// documentNodes returns all the nodes of the json document in document order
+func documentNodes(js []byte) ([]node, error) {
+	data, err := decodeOrdered(js)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []node
+	var walk func(path, key string, v interface{}) string
+	walk = func(path, key string, v interface{}) string {
+		i := len(nodes)
+		nodes = append(nodes, node{path: path, key: key, value: v})
+		var canon string
+		switch t := v.(type) {
+		case object:
+			fields := make([]string, len(t))
+			for j, f := range t {
+				c := walk(path+"/"+pointerToken(f.key), f.key, f.value)
+				fields[j] = canonical(f.key) + ":" + c
+			}
+			sort.Strings(fields)
+			canon = "{" + strings.Join(fields, ",") + "}"
+		case []interface{}:
+			elems := make([]string, len(t))
+			for j, e := range t {
+				elems[j] = walk(path+"/"+strconv.Itoa(j), "", e)
+			}
+			canon = "[" + strings.Join(elems, ",") + "]"
+		default:
+			canon = canonical(t)
+		}
+		nodes[i].canon = canon
+		return canon
+	}
+	walk("", "", data)
+	return nodes, nil
+}
+
+// canonical returns a json representation of a value such that equal values produce the
+// same string regardless of key order and number representation
+func canonical(v interface{}) string {
+	switch t := v.(type) {
+	case object:
+		m := make(map[string]interface{}, len(t))
+		for _, f := range t {
+			m[f.key] = f.value
+		}
+		return canonical(m)
+	case map[string]interface{}:
+		fields := make([]string, 0, len(t))
+		for k, e := range t {
+			fields = append(fields, canonical(k)+":"+canonical(e))
+		}
+		sort.Strings(fields)
+		return "{" + strings.Join(fields, ",") + "}"
+	case []interface{}:
+		elems := make([]string, len(t))
+		for i, e := range t {
+			elems[i] = canonical(e)
+		}
+		return "[" + strings.Join(elems, ",") + "]"
+	case json.Number:
+		if f, err := t.Float64(); err == nil {
+			return canonical(f)
+		}
+		return t.String()
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	default:
+		js, _ := json.Marshal(t)
+		return string(js)
+	}
+}
+
+// matchPaths locates the values extracted using selectExpr in the json document, a value that
+// can't be told apart from other candidates gets all their paths joined by " or "
+func matchPaths(selectExpr string, js []byte, values []interface{}) ([]match, error) {
+	nodes, err := documentNodes(js)
+	if err != nil {
+		return nil, err
+	}
+	key := lastKey(selectExpr)
+	used := make([]bool, len(nodes))
+	// candidates returns the unused nodes with the value, preferring those with the key
+	candidates := func(canon string) []int {
+		var withKey, all []int
+		for i, n := range nodes {
+			if used[i] || n.canon != canon {
+				continue
+			}
+			all = append(all, i)
+			if key != "" && n.key == key {
+				withKey = append(withKey, i)
+			}
+		}
+		if len(withKey) > 0 {
+			return withKey
+		}
+		return all
+	}
+
+	canons := make([]string, len(values))
+	for i, v := range values {
+		canons[i] = canonical(v)
+	}
+	matches := make([]match, len(values))
+	for i, v := range values {
+		cands := candidates(canons[i])
+		if len(cands) == 0 {
+			js, _ := json.Marshal(v)
+			matches[i] = match{"?", string(js)}
+			continue
+		}
+		// identical values are selected in document order, so they can only be assigned to
+		// nodes if there are as many of them as there are candidates
+		same := 0
+		for _, c := range canons[i:] {
+			if c == canons[i] {
+				same++
+			}
+		}
+		if len(cands) > same {
+			paths := make([]string, len(cands))
+			for k, j := range cands {
+				paths[k] = nodes[j].path
+			}
+			matches[i] = match{strings.Join(paths, " or "), compactJSON(nodes[cands[0]].value)}
+			continue
+		}
+		used[cands[0]] = true
+		matches[i] = match{nodes[cands[0]].path, compactJSON(nodes[cands[0]].value)}
+	}
+	return matches, nil
+}
+
+// printPaths prints the path of each extracted value followed by a tab and the value (--xpaths)
+func printPaths(selectExpr string, js []byte, values []interface{}) (string, string, int) {
+	matches, err := matchPaths(selectExpr, js, values)
+	if err != nil {
+		return "", err.Error(), 1
+	}
+	var buf bytes.Buffer
+	for _, m := range matches {
+		fmt.Fprintf(&buf, "%s\t%s\n", m.path, m.value)
+	}
+	return buf.String(), "", 0
+}
+
+// explainMatches describes where the extracted values come from for --explain: when multiple
+// values were selected it lists their paths, when nothing was selected it lists the paths of
+// the nodes having the key the expression ends with, if any
+func explainMatches(selectExpr string, js []byte, values []interface{}) string {
+	var lines []string
+	if len(values) > 0 {
+		matches, err := matchPaths(selectExpr, js, values)
+		if err != nil {
+			return ""
+		}
+		lines = append(lines, fmt.Sprintf("%d values were selected:", len(matches)))
+		for _, m := range matches {
+			lines = append(lines, fmt.Sprintf("  %s\t%s", m.path, m.value))
+		}
+	} else {
+		key := lastKey(selectExpr)
+		if key == "" {
+			return ""
+		}
+		nodes, err := documentNodes(js)
+		if err != nil {
+			return ""
+		}
+		for _, n := range nodes {
+			if n.key == key {
+				lines = append(lines, fmt.Sprintf("  %s\t%s", n.path, compactJSON(n.value)))
+			}
+		}
+		if len(lines) == 0 {
+			return fmt.Sprintf("\nthe response has no \"%s\" field", key)
+		}
+		lines = append([]string{fmt.Sprintf("candidate \"%s\" fields:", key)}, lines...)
+	}
+	if len(lines) > maxExplained+1 {
+		more := len(lines) - maxExplained - 1
+		lines = append(lines[:maxExplained+1], fmt.Sprintf("  ... and %d more", more))
+	}
+	return "\n" + strings.Join(lines, "\n")
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Match paths", func() {
+
+	js := []byte(`[
+	  {"name":"amazon","cloud_type":"amazon","id":12345678901,
+	   "links":[{"rel":"self","href":"/api/clouds/1"}]},
+	  {"name":"a/b","cloud_type":"amazon","id":2,
+	   "links":[{"rel":"self","href":"/api/clouds/2"}]}
+	]`)
+
+	It("prints the path of each match", func() {
+		parseFlags("--xpaths", `.cloud_type`)
+		stdout, _, exit := doOutput(1, false, ".cloud_type", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("/0/cloud_type\t\"amazon\"\n/1/cloud_type\t\"amazon\"\n"))
+	})
+
+	It("locates objects and large numbers", func() {
+		parseFlags("--xpaths", `object:has(.rel:val("self"))`)
+		stdout, _, exit := doOutput(1, false, `object:has(.rel:val("self"))`, &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("" +
+			"/0/links/0\t{\"rel\":\"self\",\"href\":\"/api/clouds/1\"}\n" +
+			"/1/links/0\t{\"rel\":\"self\",\"href\":\"/api/clouds/2\"}\n"))
+
+		matches, err := matchPaths(".id", js, []interface{}{12345678901.0})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(matches).Should(Equal([]match{{"/0/id", "12345678901"}}))
+	})
+
+	It("lists all the candidates of ambiguous values", func() {
+		js := []byte(`[{"n":"a","v":"x"},{"n":"b","v":"x"},{"n":"c","v":"y"}]`)
+		matches, err := matchPaths(`*:has(.n:val("b")) .v`, js, []interface{}{"x"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(matches).Should(Equal([]match{{"/0/v or /1/v", `"x"`}}))
+
+		matches, err = matchPaths(".v", js, []interface{}{"x", "x", "y"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(matches).Should(Equal([]match{{"/0/v", `"x"`}, {"/1/v", `"x"`}, {"/2/v", `"y"`}}))
+	})
+
+	It("escapes keys in json pointers", func() {
+		matches, err := matchPaths(`."a/b~c"`, []byte(`{"a/b~c":1}`), []interface{}{1.0})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(matches).Should(Equal([]match{{"/a~1b~0c", "1"}}))
+	})
+
+	It("explains multiple matches", func() {
+		parseFlags("--x1", ".name", "--explain")
+		_, stderr, exit := doOutput(1, true, ".name", &Response{}, js)
+		Ω(exit).Should(Equal(1))
+		Ω(stderr).Should(Equal("Multiple values selected\n2 values were selected:\n" +
+			"  /0/name\t\"amazon\"\n  /1/name\t\"a/b\""))
+	})
+
+	It("explains missing matches", func() {
+		parseFlags("--x1", `*:has(.name:val("x")) .href`, "--explain")
+		_, stderr, exit := doOutput(1, true, `*:has(.name:val("x")) .href`, &Response{}, js)
+		Ω(exit).Should(Equal(1))
+		Ω(stderr).Should(Equal("No value could be selected\ncandidate \"href\" fields:\n" +
+			"  /0/links/0/href\t\"/api/clouds/1\"\n  /1/links/0/href\t\"/api/clouds/2\""))
+	})
+
+})
@@ -0,0 +1,42 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== JMESPath queries
+
+// As an alternative to JSON:select, values can be extracted using JMESPath (see
+// http://jmespath.org), which can also transform the response and build new objects, for
+// example: --query '[?cloud_type==`amazon`].{name: name, href: links[?rel==`self`].href | [0]}'
+
+import (
+	"encoding/json"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+// queryValues evaluates the JMESPath expression against the json and returns the resulting
+// values: an array result produces its elements, null produces no value, and anything else is
+// a single value. This makes projections such as [*].name work like json:select.
+func queryValues(expr string, js []byte) ([]interface{}, error) {
+	q, err := jmespath.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	// jmespath compares numbers as float64, so we can't decode using json.Number here
+	var data interface{}
+	if err := json.Unmarshal(js, &data); err != nil {
+		return nil, err
+	}
+	res, err := q.Search(data)
+	if err != nil {
+		return nil, err
+	}
+	switch r := res.(type) {
+	case nil:
+		return []interface{}{}, nil
+	case []interface{}:
+		return r, nil
+	default:
+		return []interface{}{r}, nil
+	}
+}
@@ -6,9 +6,8 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"regexp"
@@ -19,64 +18,63 @@ import (
 	"github.com/onsi/gomega/ghttp"
 )
 
+// with UPDATE_RECORDINGS=1 the expected stdout and exit code of each test case are replaced
+// by what the current code produces and recording.json is rewritten, for use when the output
+// changes intentionally (review the changes using rs-api cassette diff or git diff)
+var updateRecordings = os.Getenv("UPDATE_RECORDINGS") != ""
+
 // Iterate through all recorded test cases and play them back
 var _ = Describe("Testing recorded requests", func() {
 
-	// Open the recording file
-	f, err := os.Open("recording.json")
+	// Read the recording file
+	testCases, err := readCassette("recording.json")
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "Cannot open recording: %s\n", err.Error())
+		fmt.Fprintf(os.Stdout, "Cannot read recording: %s\n", err.Error())
 		os.Exit(1)
 	}
-	decoder := json.NewDecoder(f)
 
 	// Iterate through test cases
-	for {
-		// Read a test case, which is a json struct
-		var testCase MyRecording
-		err := decoder.Decode(&testCase)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			fmt.Fprintf(os.Stderr, "Json decode: %s\n", err.Error())
-			break
-		}
+	for i, tc := range testCases {
+		i, testCase := i, tc
 
 		// Perform the test by running main() with the command line args set
 		It(strings.Join(testCase.CmdArgs, " "), func() {
+			// commands that talk to the platform directly start by authenticating, the
+			// others are replayed through the RL10 proxy
+			direct := len(testCase.Interactions) > 0 &&
+				strings.Contains(testCase.Interactions[0].Uri, "/api/oauth2")
+
 			//server := httptest.NewTLSServer(http.HandlerFunc(handler))
-			server := ghttp.NewServer()
+			var server *ghttp.Server
+			if direct {
+				server = ghttp.NewTLSServer()
+			} else {
+				server = ghttp.NewServer()
+			}
 			defer server.Close()
 
-			// construct list of verifiers
-			url := regexp.MustCompile(`https?://[^/]+(/[^?]+)\??(.*)`).
-				FindStringSubmatch(testCase.RR.Uri)
-			//fmt.Fprintf(os.Stderr, "URL: %#v\n", url)
-			handlers := []http.HandlerFunc{
-				ghttp.VerifyRequest(testCase.RR.Verb, url[1], url[2]),
-			}
-			if len(testCase.RR.ReqBody) > 0 {
-				handlers = append(handlers,
-					ghttp.VerifyJSON(testCase.RR.ReqBody))
-			}
-			for k, _ := range testCase.RR.ReqHeader {
+			// construct list of verifiers for each interaction, in order
+			for _, rr := range testCase.Interactions {
+				handlers := []http.HandlerFunc{verifyInteraction(rr)}
+				respHeader := make(http.Header)
+				for k, v := range rr.RespHeader {
+					respHeader[k] = v
+				}
 				handlers = append(handlers,
-					ghttp.VerifyHeaderKV(k, testCase.RR.ReqHeader.Get(k)))
+					ghttp.RespondWith(rr.Status, rr.RespBody, respHeader))
+				server.AppendHandlers(ghttp.CombineHandlers(handlers...))
 			}
-			respHeader := make(http.Header)
-			for k, v := range testCase.RR.RespHeader {
-				respHeader[k] = v
+
+			hostPort := regexp.MustCompile(`^https?://`).ReplaceAllString(server.URL(), "")
+			if direct {
+				os.Args = append([]string{"rs-api"}, testCase.CmdArgs...)
+			} else {
+				os.Args = append([]string{
+					"rs-api", "--rl10",
+					//"--debug",
+					"--host", hostPort},
+					testCase.CmdArgs...)
 			}
-			handlers = append(handlers,
-				ghttp.RespondWith(testCase.RR.Status, testCase.RR.RespBody,
-					respHeader))
-			server.AppendHandlers(ghttp.CombineHandlers(handlers...))
-
-			os.Args = append([]string{
-				"rs-api", "--rl10",
-				//"--debug",
-				"--host", strings.TrimPrefix(server.URL(), "http://")},
-				testCase.CmdArgs...)
 			fmt.Fprintf(os.Stderr, "testing \"%s\"\n", strings.Join(os.Args, `" "`))
 
 			// capture stdout and intercept calls to osExit
@@ -85,11 +83,22 @@ var _ = Describe("Testing recorded requests", func() {
 			exitCode := 99
 			osExit = func(code int) { exitCode = code }
 			rsClientInternal = nil
-			//rightscale().SetInsecure()
+			if direct {
+				// the test server has a self-signed cert
+				rsClientInternal, _ = NewDirectClient(hostPort, "test-key", false)
+				rsClientInternal.SetInsecure()
+			}
 
 			main()
 
-			// Verify that stdout and the exit code are correct
+			// Verify that all interactions happened, and stdout and the exit code are correct
+			Ω(server.ReceivedRequests()).Should(HaveLen(len(testCase.Interactions)),
+				"Number of requests doesn't match")
+			if updateRecordings {
+				testCases[i].Stdout, testCases[i].ExitCode = stdoutBuf.String(), exitCode
+				Ω(writeCassette("recording.json", testCases)).Should(Succeed())
+				return
+			}
 			//fmt.Fprintf(os.Stderr, "Exit %d %d\n", exitCode, testCase.ExitCode)
 			Ω(exitCode).Should(Equal(testCase.ExitCode), "Exit code doesn't match")
 			//fmt.Fprintf(os.Stderr, "stdout got <<%s>> expected <<%s>>\n",
@@ -99,3 +108,13 @@ var _ = Describe("Testing recorded requests", func() {
 	}
 
 })
+
+// verifyInteraction verifies that a request matches the recorded interaction, see
+// matchRequest
+func verifyInteraction(rr RequestRecording) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(matchRequest(rr, req, string(body), nil)).Should(Succeed())
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Record extraction
+
+// --xo extracts several fields from each resource of a collection in one go, for example
+// --xo 'name=.name,href=object:has(.rel:val("self")).href' prints one json object per resource
+// with a name and an href field. Each field is a json:select expression evaluated relative to
+// the resource, a field that selects nothing is null and a field that selects multiple values
+// is an array. A single resource produces a single record. The records can also be printed as
+// a table, csv, or tsv using --format.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rightscale/go-jsonselect"
+)
+
+// recordField is a field of --xo: the name and the json:select expression
+type recordField struct {
+	name string
+	expr string
+}
+
+var reRecordField = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=(.+)$`)
+
+// parseRecordFields parses the --xo specification. Fields are separated by commas, a comma that
+// is not followed by name= is part of the expression (json:select uses commas to combine
+// selectors) as are commas within quotes or parentheses.
+func parseRecordFields(spec string) ([]recordField, error) {
+	fields := []recordField{}
+	for _, part := range splitTopLevel(spec) {
+		if m := reRecordField.FindStringSubmatch(part); m != nil {
+			fields = append(fields, recordField{m[1], strings.TrimSpace(m[2])})
+		} else if len(fields) > 0 {
+			fields[len(fields)-1].expr += "," + part
+		} else {
+			return nil, fmt.Errorf("--xo '%s' is not of the form "+
+				"name=<json:select>,name=<json:select>,...", spec)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("--xo requires at least one name=<json:select> field")
+	}
+	return fields, nil
+}
+
+// splitTopLevel splits at commas that are neither quoted nor within parentheses
+func splitTopLevel(s string) []string {
+	parts := []string{}
+	depth, start := 0, 0
+	var quote rune
+	escaped := false
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// extractRecords evaluates the fields for each resource in the json
+func extractRecords(fields []recordField, js []byte) ([]object, error) {
+	if len(bytes.TrimSpace(js)) == 0 {
+		return []object{}, nil
+	}
+	data, err := decodeOrdered(js)
+	if err != nil {
+		return nil, err
+	}
+	elems, ok := data.([]interface{})
+	if !ok {
+		elems = []interface{}{data}
+	}
+
+	records := make([]object, len(elems))
+	for i, e := range elems {
+		parser, err := jsonselect.CreateParserFromString(compactJSON(e))
+		if err != nil {
+			return nil, err
+		}
+		records[i] = make(object, len(fields))
+		for j, f := range fields {
+			values, err := parser.GetValues(f.expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.name, err.Error())
+			}
+			var v interface{}
+			switch len(values) {
+			case 0:
+			case 1:
+				v = values[0]
+			default:
+				v = values
+			}
+			records[i][j] = field{f.name, v}
+		}
+	}
+	return records, nil
+}
+
+// printRecords prints one json object per line or, if format is table, csv, or tsv, one row
+// per record
+func printRecords(fields []recordField, records []object, format string, termWidth int) string {
+	if format == "" || format == "json" {
+		var buf bytes.Buffer
+		for _, r := range records {
+			writeJSON(&buf, r)
+			buf.WriteByte('\n')
+		}
+		return buf.String()
+	}
+
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = f.name
+	}
+	cells := make([][]string, len(records))
+	for i, r := range records {
+		cells[i] = make([]string, len(r))
+		for j, f := range r {
+			cells[i][j] = formatCell(f.value)
+		}
+	}
+	return formatRows(format, cols, cells, termWidth)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Record extraction", func() {
+
+	js := []byte(`[
+	  {"name":"web, 1","id":12345678901,"tags":["a","b"],
+	   "links":[{"rel":"self","href":"/api/servers/1"},{"rel":"deployment","href":"/api/deployments/9"}]},
+	  {"name":"db","id":2,"tags":[],
+	   "links":[{"rel":"self","href":"/api/servers/2"}]}
+	]`)
+	spec := `name=.name,href=object:has(.rel:val("self")).href,dep=object:has(.rel:val("deployment")).href`
+
+	It("parses fields with commas in expressions", func() {
+		fields, err := parseRecordFields(`a=.x, .y,b=:has(.rel:val("a,b=c")).href`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fields).Should(Equal([]recordField{
+			{"a", ".x, .y"}, {"b", `:has(.rel:val("a,b=c")).href`}}))
+
+		_, err = parseRecordFields(".name")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("prints one json object per resource", func() {
+		parseFlags("--xo", spec+",id=.id")
+		stdout, _, exit := doOutput(1, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("" +
+			`{"name":"web, 1","href":"/api/servers/1","dep":"/api/deployments/9","id":12345678901}` + "\n" +
+			`{"name":"db","href":"/api/servers/2","dep":null,"id":2}` + "\n"))
+	})
+
+	It("prints csv rows", func() {
+		parseFlags("--xo", spec, "--format", "csv")
+		stdout, _, exit := doOutput(1, false, "", &Response{}, js)
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal("name,href,dep\n" +
+			"\"web, 1\",/api/servers/1,/api/deployments/9\ndb,/api/servers/2,\n"))
+	})
+
+	It("produces a single record for a single resource", func() {
+		parseFlags("--xo", "name=.name,tags=.tags string")
+		stdout, _, exit := doOutput(1, false, "",
+			&Response{}, []byte(`{"name":"x","tags":["a","b"]}`))
+		Ω(exit).Should(Equal(0))
+		Ω(stdout).Should(Equal(`{"name":"x","tags":["a","b"]}` + "\n"))
+	})
+
+})
@@ -0,0 +1,220 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Redaction of secrets
+
+// Recordings and --debug dumps must not reveal credentials, so the values of sensitive
+// headers, query (and form) parameters, and json body fields are replaced by REDACTED before
+// anything is written out. Built-in rules cover the API key sent as refresh_token, access
+// tokens, the RL10 proxy secret, cookies, and passwords; --redact-header, --redact-param, and
+// --redact-field add more. Each rule is a regular expression matched case-insensitively
+// against the entire name, e.g. --redact-param 'credential\[value\]'. Redaction leaves
+// anything it doesn't change byte-for-byte untouched, in particular json bodies are only
+// re-encoded if they contained a field to redact.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// value that replaces secrets
+const redactedValue = "REDACTED"
+
+// built-in redaction rules
+var (
+	redactedHeaders = []string{"Authorization", "X-RLL-Secret", "Cookie", "Set-Cookie"}
+	redactedParams  = []string{"refresh_token", "access_token", "password", `.*\[password\]`}
+	redactedFields  = []string{"refresh_token", "access_token", "password"}
+)
+
+// redactor hides the values of the headers, params, and fields that match its rules
+type redactor struct {
+	headers []*regexp.Regexp
+	params  []*regexp.Regexp
+	fields  []*regexp.Regexp
+}
+
+// redactor with just the built-in rules
+var defaultRedactor, _ = newRedactor(nil, nil, nil)
+
+// newRedactor creates a redactor with the built-in rules plus the given ones
+func newRedactor(headers, params, fields []string) (*redactor, error) {
+	compile := func(what string, builtin, extra []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, p := range append(append([]string{}, builtin...), extra...) {
+			re, err := regexp.Compile(`(?i)^(?:` + p + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --redact-%s pattern '%s': %s", what, p,
+					err.Error())
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	var r redactor
+	var err error
+	if r.headers, err = compile("header", redactedHeaders, headers); err != nil {
+		return nil, err
+	}
+	if r.params, err = compile("param", redactedParams, params); err != nil {
+		return nil, err
+	}
+	if r.fields, err = compile("field", redactedFields, fields); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// rules returns the redactor to use, the default one for a nil redactor
+func (r *redactor) rules() *redactor {
+	if r == nil {
+		return defaultRedactor
+	}
+	return r
+}
+
+// matches returns whether the name matches any of the rules
+func matches(rules []*regexp.Regexp, name string) bool {
+	for _, re := range rules {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns a copy of the headers with sensitive values redacted
+func (r *redactor) header(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	res := make(http.Header, len(h))
+	for k, v := range h {
+		if matches(r.rules().headers, k) {
+			v = []string{redactedValue}
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// query redacts the values of sensitive params in a query string or form body, preserving the
+// order and encoding of all params
+func (r *redactor) query(q string) string {
+	if q == "" {
+		return q
+	}
+	params := strings.Split(q, "&")
+	for i, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		k, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			k = kv[0]
+		}
+		if len(kv) == 2 && matches(r.rules().params, k) {
+			params[i] = kv[0] + "=" + redactedValue
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uri redacts the query string of a uri
+func (r *redactor) uri(uri string) string {
+	if i := strings.Index(uri, "?"); i >= 0 {
+		return uri[:i+1] + r.query(uri[i+1:])
+	}
+	return uri
+}
+
+// body redacts a json or form body
+func (r *redactor) body(contentType, body string) string {
+	trimmed := strings.TrimSpace(body)
+	switch {
+	case strings.Contains(contentType, "json") || strings.HasPrefix(trimmed, "{") ||
+		strings.HasPrefix(trimmed, "["):
+		return r.json(body)
+	case strings.Contains(contentType, "x-www-form-urlencoded"):
+		return r.query(body)
+	}
+	return body
+}
+
+// json redacts sensitive fields anywhere in a json document, the document is returned as is
+// if it has no such fields or cannot be parsed
+func (r *redactor) json(body string) string {
+	data, err := decodeOrdered([]byte(body))
+	if err != nil {
+		return body
+	}
+	changed := false
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case object:
+			for i, f := range t {
+				if matches(r.rules().fields, f.key) {
+					t[i].value = redactedValue
+					changed = true
+				} else {
+					walk(f.value)
+				}
+			}
+		case []interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		}
+	}
+	walk(data)
+	if !changed {
+		return body
+	}
+	return compactJSON(data)
+}
+
+// dump redacts a request or response dumped by httputil: the uri of the request line, the
+// header values, and the body
+func (r *redactor) dump(dump []byte) []byte {
+	head, body := dump, []byte{}
+	if i := bytes.Index(dump, []byte("\r\n\r\n")); i >= 0 {
+		head, body = dump[:i], dump[i+4:]
+	}
+	lines := strings.Split(string(head), "\r\n")
+	if f := strings.SplitN(lines[0], " ", 3); len(f) == 3 && !strings.HasPrefix(f[0], "HTTP/") {
+		f[1] = r.uri(f[1])
+		lines[0] = strings.Join(f, " ")
+	}
+	contentType := ""
+	for i, l := range lines[1:] {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if strings.EqualFold(kv[0], "Content-Type") {
+			contentType = strings.TrimSpace(kv[1])
+		}
+		if matches(r.rules().headers, kv[0]) {
+			lines[i+1] = kv[0] + ": " + redactedValue
+		}
+	}
+	res := strings.Join(lines, "\r\n")
+	if len(dump) > len(head) {
+		res += "\r\n\r\n" + r.body(contentType, string(body))
+	}
+	return []byte(res)
+}
+
+// recording redacts a recorded interaction
+func (r *redactor) recording(rr RequestRecording) RequestRecording {
+	rr.Uri = r.uri(rr.Uri)
+	rr.ReqBody = r.body(rr.ReqHeader.Get("Content-Type"), rr.ReqBody)
+	rr.ReqHeader = r.header(rr.ReqHeader)
+	rr.RespBody = r.body(rr.RespHeader.Get("Content-Type"), rr.RespBody)
+	rr.RespHeader = r.header(rr.RespHeader)
+	return rr
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redaction", func() {
+
+	It("redacts the built-in secrets", func() {
+		var r *redactor // nil uses the built-in rules
+		Ω(r.uri("/api/oauth2?grant_type=refresh_token&refresh_token=abc%2Fdef")).Should(Equal(
+			"/api/oauth2?grant_type=refresh_token&refresh_token=REDACTED"))
+		Ω(r.query("user[email]=a@b.c&user[password]=x&password=y")).Should(Equal(
+			"user[email]=a@b.c&user[password]=REDACTED&password=REDACTED"))
+		Ω(r.header(http.Header{"X-Rll-Secret": {"s"}, "Accept": {"a"}})).Should(Equal(
+			http.Header{"X-Rll-Secret": {"REDACTED"}, "Accept": {"a"}}))
+		Ω(r.body("application/json", `{"access_token":"t","expires_in":7200}`)).Should(Equal(
+			`{"access_token":"REDACTED","expires_in":7200}`))
+	})
+
+	It("leaves bodies without secrets untouched", func() {
+		Ω(defaultRedactor.body("application/json", `{ "name": "x" }`)).Should(
+			Equal(`{ "name": "x" }`))
+		Ω(defaultRedactor.body("text/plain", "password=x")).Should(Equal("password=x"))
+	})
+
+	It("redacts user-supplied patterns", func() {
+		r, err := newRedactor([]string{"x-api-.*"}, []string{`credential\[value\]`},
+			[]string{"secret"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.header(http.Header{"X-Api-Token": {"s"}})).Should(Equal(
+			http.Header{"X-Api-Token": {"REDACTED"}}))
+		Ω(r.query("credential[name]=n&credential%5Bvalue%5D=v")).Should(Equal(
+			"credential[name]=n&credential%5Bvalue%5D=REDACTED"))
+		Ω(r.json(`[{"secret":{"a":1},"name":"n"}]`)).Should(Equal(
+			`[{"secret":"REDACTED","name":"n"}]`))
+
+		_, err = newRedactor(nil, []string{"("}, nil)
+		Ω(err).Should(MatchError(ContainSubstring("invalid --redact-param pattern '('")))
+	})
+
+	It("redacts debug dumps", func() {
+		dump := "POST /api/oauth2?refresh_token=key HTTP/1.1\r\nHost: h\r\n" +
+			"Authorization: Bearer tok\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+			"\r\npassword=pw&name=n"
+		Ω(string(defaultRedactor.dump([]byte(dump)))).Should(Equal(
+			"POST /api/oauth2?refresh_token=REDACTED HTTP/1.1\r\nHost: h\r\n" +
+				"Authorization: REDACTED\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+				"\r\npassword=REDACTED&name=n"))
+
+		dump = "HTTP/1.1 200 OK\r\nSet-Cookie: s=1\r\n\r\n{\"access_token\":\"t\"}"
+		Ω(string(defaultRedactor.dump([]byte(dump)))).Should(Equal(
+			"HTTP/1.1 200 OK\r\nSet-Cookie: REDACTED\r\n\r\n{\"access_token\":\"REDACTED\"}"))
+	})
+})
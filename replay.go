@@ -0,0 +1,84 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Replaying recorded interactions
+
+// With --replay the client doesn't use the network at all, instead each request is answered
+// with the response of a matching interaction recorded in a cassette, which makes it possible
+// to test scripts that call rs-api offline. Requests are matched against interactions as
+// described in requestmatch.go. Interactions are used in the order they were recorded, so a
+// request repeated within a command gets the successive recorded responses, once all matching
+// interactions are used up the last one is repeated. A request without any matching
+// interaction fails.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// replayTransport is an http.RoundTripper that answers requests from recorded interactions
+type replayTransport struct {
+	sync.Mutex
+	interactions []RequestRecording
+	used         []bool
+	redact       *redactor // secrets that are redacted in recordings
+}
+
+// newReplayTransport creates a transport replaying the interactions in order
+func newReplayTransport(interactions []RequestRecording) *replayTransport {
+	return &replayTransport{interactions: interactions, used: make([]bool, len(interactions))}
+}
+
+// RoundTrip responds to the request with the first unused matching interaction or, failing
+// that, the last matching one
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	found := -1
+	for i, rr := range t.interactions {
+		if matchRequest(rr, req, string(body), t.redact) != nil {
+			continue
+		}
+		found = i
+		if !t.used[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("replay: no recorded interaction matches %s %s", req.Method,
+			req.URL.RequestURI())
+	}
+	t.used[found] = true
+
+	rr := t.interactions[found]
+	header := make(http.Header, len(rr.RespHeader))
+	for k, v := range rr.RespHeader {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rr.Status, http.StatusText(rr.Status)),
+		StatusCode:    rr.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(rr.RespBody)),
+		ContentLength: int64(len(rr.RespBody)),
+		Request:       req,
+	}, nil
+}
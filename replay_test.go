@@ -0,0 +1,90 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Replaying recorded interactions", func() {
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	interactions := []RequestRecording{
+		{Verb: "POST",
+			Uri:        "https://us-3.rightscale.com/api/oauth2?grant_type=refresh_token&refresh_token=test-key",
+			Status:     200,
+			RespHeader: jsonHeader,
+			RespBody:   `{"access_token":"abc"}`},
+		{Verb: "GET", Uri: "https://us-3.rightscale.com/api/clouds/1/instances?filter[]=state%3D%3Dpending&filter[]=name%3D%3Dx&view=default",
+			Status: 200, RespHeader: jsonHeader, RespBody: `[{"state":"pending"}]`},
+		{Verb: "GET", Uri: "https://us-3.rightscale.com/api/clouds/1/instances/1",
+			Status: 200, RespHeader: jsonHeader, RespBody: `{"state":"pending"}`},
+		{Verb: "GET", Uri: "https://us-3.rightscale.com/api/clouds/1/instances/1",
+			Status: 200, RespHeader: jsonHeader, RespBody: `{"state":"operational"}`},
+	}
+
+	var c Client
+
+	BeforeEach(func() {
+		c, _ = NewDirectClient("localhost:1", "my-real-key", false)
+		c.SetRetry(RetryPolicy{})
+		c.Replay(interactions)
+	})
+
+	It("authenticates and matches queries regardless of parameter order", func() {
+		resp, err := c.Do(context.Background(), "GET", "/api/clouds/1/instances",
+			[]string{"view=default", "filter[]=state%3D%3Dpending", "filter[]=name==x"}, "", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(resp.raw)).Should(Equal(`[{"state":"pending"}]`))
+	})
+
+	It("keeps the order of repeated parameters", func() {
+		_, err := c.Do(context.Background(), "GET", "/api/clouds/1/instances",
+			[]string{"filter[]=name==x", "filter[]=state==pending", "view=default"}, "", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("replay: no recorded interaction matches GET " +
+			"/api/clouds/1/instances?filter[]=name==x&filter[]=state==pending&view=default"))
+	})
+
+	It("replays repeated requests in order and then repeats the last response", func() {
+		states := []string{}
+		for i := 0; i < 3; i++ {
+			resp, err := c.Do(context.Background(), "GET", "/api/clouds/1/instances/1",
+				nil, "", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			states = append(states, string(resp.raw))
+		}
+		Ω(states).Should(Equal([]string{`{"state":"pending"}`, `{"state":"operational"}`,
+			`{"state":"operational"}`}))
+	})
+
+	It("runs commands against a cassette", func() {
+		dir, err := ioutil.TempDir("", "rs-api")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		cassette := filepath.Join(dir, "cassette.json")
+		recordToFile(cassette, MyRecording{Interactions: interactions[2:]})
+
+		os.Args = []string{"rs-api", "--rl10", "--replay", cassette,
+			"--x1", ".state", "show", "/api/clouds/1/instances/1"}
+		stdoutBuf := bytes.Buffer{}
+		osStdout = &stdoutBuf
+		exitCode := 99
+		osExit = func(code int) { exitCode = code }
+		rsClientInternal = nil
+
+		main()
+
+		Ω(exitCode).Should(Equal(0))
+		Ω(stdoutBuf.String()).Should(Equal("pending"))
+	})
+
+})
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Matching requests against recordings
+
+// Replay mode and the recorded-request tests both need to decide whether a request is the one
+// that was recorded. Comparing raw strings is too brittle: the order of query parameters
+// depends on the command line, json bodies can be encoded differently, and header names are
+// case-insensitive. So query strings and form bodies are compared as multisets of parameters,
+// only the order of repeated parameters such as filter[] matters, json bodies are compared
+// structurally, and each recorded header must be present with the same value. Secrets are
+// redacted on both sides first since recordings don't hold them (see redact.go).
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// matchRequest returns nil if the request, whose body has already been read, matches the
+// recorded interaction and otherwise an error describing the first difference
+func matchRequest(rr RequestRecording, req *http.Request, body string, redact *redactor) error {
+	if rr.Verb != req.Method {
+		return fmt.Errorf("method %s doesn't match recorded %s", req.Method, rr.Verb)
+	}
+	u, err := url.Parse(rr.Uri)
+	if err != nil {
+		return fmt.Errorf("cannot parse recorded uri %s: %s", rr.Uri, err.Error())
+	}
+	if u.Path != req.URL.Path {
+		return fmt.Errorf("path %s doesn't match recorded %s", req.URL.Path, u.Path)
+	}
+	exp := normalizeQuery(redact.query(u.RawQuery))
+	act := normalizeQuery(redact.query(req.URL.RawQuery))
+	if exp != act {
+		return fmt.Errorf("query %s doesn't match recorded %s", act, exp)
+	}
+	expHeader, actHeader := redact.header(rr.ReqHeader), redact.header(req.Header)
+	for k, v := range expHeader {
+		exp := strings.Join(v, ", ")
+		act := strings.Join(actHeader[http.CanonicalHeaderKey(k)], ", ")
+		if exp != act {
+			return fmt.Errorf("header %s: %q doesn't match recorded %q", k, act, exp)
+		}
+	}
+	contentType := rr.ReqHeader.Get("Content-Type")
+	if contentType == "" {
+		contentType = req.Header.Get("Content-Type")
+	}
+	if !bodiesMatch(contentType, redact.body(contentType, rr.ReqBody),
+		redact.body(contentType, body)) {
+		return fmt.Errorf("body %s doesn't match recorded %s", body, rr.ReqBody)
+	}
+	return nil
+}
+
+// bodiesMatch compares json bodies structurally, form bodies like queries, and others exactly
+func bodiesMatch(contentType, expected, actual string) bool {
+	if expected == actual {
+		return true
+	}
+	if strings.Contains(contentType, "x-www-form-urlencoded") {
+		return normalizeQuery(expected) == normalizeQuery(actual)
+	}
+	exp, err1 := decodeOrdered([]byte(expected))
+	act, err2 := decodeOrdered([]byte(actual))
+	return err1 == nil && err2 == nil && canonical(exp) == canonical(act)
+}
+
+// normalizeQuery sorts the query parameters by name, keeping the order of repeated parameters,
+// and escapes them uniformly
+func normalizeQuery(q string) string {
+	v, err := url.ParseQuery(q)
+	if err != nil {
+		return q
+	}
+	return v.Encode()
+}
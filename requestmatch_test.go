@@ -0,0 +1,69 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request matching", func() {
+
+	rr := RequestRecording{Verb: "POST",
+		Uri:       "https://h/api/deployments?a=1&filter[]=x&filter[]=y&refresh_token=REDACTED",
+		ReqHeader: http.Header{"x-api-version": {"1.5"}, "Content-Type": {"application/json"}},
+		ReqBody:   `{"deployment":{"name":"n","tags":["a","b"]},"count":1}`,
+	}
+
+	request := func(uri, body string) *http.Request {
+		req, _ := http.NewRequest("POST", uri, strings.NewReader(body))
+		req.Header.Set("X-API-Version", "1.5")
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	It("ignores the order of query params, json fields, and the case of headers", func() {
+		req := request("http://other/api/deployments?filter%5B%5D=x&refresh_token=key&a=1"+
+			"&filter[]=y", `{"count":1.0, "deployment":{"tags":["a","b"],"name":"n"}}`)
+		Ω(matchRequest(rr, req, `{"count":1.0, "deployment":{"tags":["a","b"],"name":"n"}}`,
+			nil)).Should(Succeed())
+	})
+
+	It("reports differences", func() {
+		body := `{"deployment":{"name":"n","tags":["a","b"]},"count":1}`
+		req := request("http://h/api/deployments?a=1&filter[]=y&filter[]=x", body)
+		Ω(matchRequest(rr, req, body, nil)).Should(MatchError(
+			"query a=1&filter%5B%5D=y&filter%5B%5D=x doesn't match recorded " +
+				"a=1&filter%5B%5D=x&filter%5B%5D=y&refresh_token=REDACTED"))
+
+		req = request("http://h/api/deployments?a=1&filter[]=x&filter[]=y&refresh_token=k", body)
+		req.Header.Set("X-Api-Version", "1.6")
+		Ω(matchRequest(rr, req, body, nil)).Should(MatchError(
+			`header x-api-version: "1.6" doesn't match recorded "1.5"`))
+
+		req.Header.Set("X-Api-Version", "1.5")
+		Ω(matchRequest(rr, req, `{"deployment":{"name":"n","tags":["b","a"]},"count":1}`,
+			nil)).Should(MatchError(ContainSubstring("body")))
+
+		req.Method = "PUT"
+		Ω(matchRequest(rr, req, body, nil)).Should(MatchError(
+			"method PUT doesn't match recorded POST"))
+	})
+
+	It("compares form bodies like queries", func() {
+		ct := "application/x-www-form-urlencoded"
+		Ω(bodiesMatch(ct, "a=1&b=2&b=3", "b=2&a=1&b=3")).Should(BeTrue())
+		Ω(bodiesMatch(ct, "a=1&b=2&b=3", "b=3&a=1&b=2")).Should(BeFalse())
+		Ω(bodiesMatch("text/plain", "a", "b")).Should(BeFalse())
+	})
+
+	It("builds query strings independently of map order", func() {
+		Ω(queryStringArgs(map[string]interface{}{"view": "default",
+			"filter[]": []string{"name==x", "cloud_href==/api/clouds/1"}, "a": "b"})).Should(Equal(
+			"a=b&filter%5B%5D=name%3D%3Dx&filter%5B%5D=cloud_href%3D%3D%2Fapi%2Fclouds%2F1" +
+				"&view=default"))
+	})
+})
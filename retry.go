@@ -0,0 +1,123 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Retry policy
+
+// Requests that fail due to network errors or due to transient server-side conditions are
+// retried with an exponential backoff. The backoff starts at retryBaseWait and doubles with
+// every attempt, it is randomized ("jittered") so many clients that fail at the same time don't
+// all come back at the same time, and it is capped at the policy's MaxWait. If the server
+// tells us how long to wait using a Retry-After header we honor that instead. Requests that
+// time out are not retried, see client.do, so --timeout bounds how long a hung request takes.
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how failed requests are retried
+type RetryPolicy struct {
+	Retries int           // max number of retries after the initial attempt
+	MaxWait time.Duration // max time to wait between two attempts
+	Unsafe  bool          // retry non-idempotent requests (POST) even if they may have executed
+}
+
+// DefaultRetryPolicy is the policy used by clients until SetRetry is called
+var DefaultRetryPolicy = RetryPolicy{Retries: 3, MaxWait: 30 * time.Second}
+
+// initial wait between attempts, var so tests can speed things up
+var retryBaseWait = 1 * time.Second
+
+// sleep between attempts, var so tests can intercept it
+var retrySleep = sleepContext
+
+// sleepContext sleeps for the given duration, it returns early with an error if the context
+// is cancelled in the meantime
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HTTP response codes that indicate a transient condition and that are worth retrying
+var retryStatus = map[int]bool{
+	http.StatusTooManyRequests:    true, // 429
+	http.StatusBadGateway:         true, // 502
+	http.StatusServiceUnavailable: true, // 503
+	http.StatusGatewayTimeout:     true, // 504
+}
+
+// HTTP verbs that can be repeated without changing the outcome
+var idempotentMethods = map[string]bool{
+	"GET": true, "HEAD": true, "OPTIONS": true, "PUT": true, "DELETE": true,
+}
+
+// next decides whether to retry after the given attempt (the initial attempt being 1) and
+// how long to wait first. The response is nil if the request failed without producing one.
+// A 429 means the request was rejected before doing anything, so it's always safe to retry,
+// other failures are only retried for requests that are safe to repeat. A Retry-After header
+// asking us to wait longer than MaxWait makes us give up.
+func (p RetryPolicy) next(attempt int, safe bool, resp *Response) (time.Duration, bool) {
+	if attempt > p.Retries {
+		return 0, false
+	}
+	if resp != nil && !retryStatus[resp.statusCode] {
+		return 0, false
+	}
+	if !safe && !p.Unsafe && (resp == nil || resp.statusCode != http.StatusTooManyRequests) {
+		return 0, false
+	}
+	if resp != nil {
+		if wait, ok := retryAfter(resp.header, time.Now()); ok {
+			return wait, wait <= p.MaxWait
+		}
+	}
+	return p.backoff(attempt + 1), true
+}
+
+// backoff returns how long to wait before the given attempt (the initial attempt being 1),
+// the result is between half and all of the exponential backoff, and is capped at MaxWait
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.MaxWait
+	if attempt < 32 {
+		if w := retryBaseWait << uint(attempt-2); w > 0 && w < wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number of seconds
+// or an HTTP date, and returns the time to wait, ok is false if the header is absent or invalid
+func retryAfter(h http.Header, now time.Time) (wait time.Duration, ok bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if wait = t.Sub(now); wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,414 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Scenarios
+
+// A scenario is a json file describing a sequence of rs-api commands, it's used to record the
+// test fixtures against a live account and to check them offline:
+//   rs-api scenario run --host us-3.rightscale.com --key $RS_KEY --record new.json scenario.json
+//   rs-api scenario run --replay recording.json scenario.json
+// Each step is one rs-api invocation (the runner executes itself) made of flags, an action, an
+// href, and params, all of which can refer to variables as ${name}. Variables come from the
+// scenario's vars, from --var name=value, and from captures: a step can capture its trimmed
+// output into a variable, or the Location header of its response, in which case --xh location
+// is added to the step and the header is the first line of the output. A step fails if its
+// exit code is not one of the expected ones (0 by default) or, if it has "lines", its output
+// doesn't have that many lines. A step with "until" is repeated every "interval" until its
+// output equals the value, up to "attempts" times, and a step with "if" only runs if the named
+// variable is not empty. Cleanup steps run after the steps even if
+// one of them failed.
+// Offline (--replay) each step is answered by the next unused recording of the same command in
+// the cassette, its output and exit code must match the recorded ones. Polling is replayed as
+// recorded: it stops when the recorded attempts are used up. Recordings that start with an
+// oauth2 request are replayed directly, others through a simulated RL10 proxy, just like in
+// recording_test.go.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+// scenario is the content of a scenario file
+type scenario struct {
+	Name    string            `json:"name"`
+	Vars    map[string]string `json:"vars"`
+	Steps   []scenarioStep    `json:"steps"`
+	Cleanup []scenarioStep    `json:"cleanup"`
+}
+
+// scenarioStep is one rs-api command of a scenario
+type scenarioStep struct {
+	Name     string            `json:"name"`
+	Flags    []string          `json:"flags"`
+	Action   string            `json:"action"`
+	Href     string            `json:"href"`
+	Params   []string          `json:"params"`
+	Capture  map[string]string `json:"capture"` // variable name to "output" or "location"
+	Exit     []int             `json:"exit"`    // expected exit codes, default 0
+	If       string            `json:"if"`      // variable that must not be empty
+	Until    string            `json:"until"`   // output that ends polling
+	Attempts int               `json:"attempts"`
+	Interval string            `json:"interval"`
+	Lines    int               `json:"lines"` // expected number of lines of output, if set
+}
+
+// scenarioCmd implements the scenario subcommand
+func scenarioCmd(args []string) {
+	cmd := kingpin.New("rs-api scenario", `Run scenarios of rs-api commands
+
+rs-api scenario run executes the steps of a scenario file against the API, typically to
+record test fixtures using --record, or offline against a cassette using --replay.
+`)
+	run := cmd.Command("run", "run a scenario")
+	host := run.Flag("host", "RightScale login endpoint (e.g. 'us-3.rightscale.com')").String()
+	key := run.Flag("key", "RightScale API key").String()
+	rl10 := run.Flag("rl10", "proxy requests through RightLink10").Bool()
+	record := run.Flag("record", "record all steps in the cassette file").String()
+	replay := run.Flag("replay", "run offline against the steps recorded in the cassette file").
+		String()
+	vars := run.Flag("var", "set a variable, repeatable, ex: --var name=value").Strings()
+	file := run.Arg("scenario", "scenario file").Required().String()
+	_ = kingpin.MustParse(cmd.Parse(args))
+
+	if *record != "" && *replay != "" {
+		kingpin.Fatalf("only one of --record and --replay can be specified")
+	}
+	sc, err := readScenario(*file)
+	kingpin.FatalIfError(err, "")
+
+	r := &scenarioRunner{vars: map[string]string{}, log: os.Stdout, exec: execSelf,
+		sleep: time.Sleep}
+	for k, v := range sc.Vars {
+		r.vars[k] = v
+	}
+	for _, v := range *vars {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			kingpin.Fatalf("--var '%s' is not of the form name=value", v)
+		}
+		r.vars[kv[0]] = kv[1]
+	}
+	if *host != "" {
+		r.global = append(r.global, "--host", *host)
+	}
+	if *key != "" {
+		r.global = append(r.global, "--key", *key)
+	}
+	if *rl10 {
+		r.global = append(r.global, "--rl10")
+	}
+	if *record != "" {
+		r.global = append(r.global, "--record", *record)
+	}
+	if *replay != "" {
+		r.cassette, err = readCassette(*replay)
+		kingpin.FatalIfError(err, "")
+		r.used = make([]bool, len(r.cassette))
+	}
+
+	if failed := r.run(sc); failed > 0 {
+		kingpin.Fatalf("%d steps of %s failed", failed, *file)
+	}
+}
+
+// readScenario reads and checks a scenario file
+func readScenario(filename string) (*scenario, error) {
+	js, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	var sc scenario
+	if err := dec.Decode(&sc); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	for _, s := range append(append([]scenarioStep{}, sc.Steps...), sc.Cleanup...) {
+		if s.Action == "" || s.Href == "" {
+			return nil, fmt.Errorf("%s: step '%s' needs an action and an href", filename,
+				s.name())
+		}
+		for v, what := range s.Capture {
+			if what != "output" && what != "location" {
+				return nil, fmt.Errorf("%s: step '%s' captures %s from '%s', expected "+
+					"output or location", filename, s.name(), v, what)
+			}
+		}
+		if s.Interval != "" {
+			if _, err := time.ParseDuration(s.Interval); err != nil {
+				return nil, fmt.Errorf("%s: step '%s': %s", filename, s.name(), err.Error())
+			}
+		}
+	}
+	return &sc, nil
+}
+
+// name returns the name of the step or, if it has none, its action and href
+func (s scenarioStep) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Action + " " + s.Href
+}
+
+// capturesLocation returns whether the step captures the location header
+func (s scenarioStep) capturesLocation() bool {
+	for _, what := range s.Capture {
+		if what == "location" {
+			return true
+		}
+	}
+	return false
+}
+
+// scenarioRunner runs the steps of scenarios
+type scenarioRunner struct {
+	global   []string          // flags passed to every step, e.g. --host and --key
+	vars     map[string]string // variables set so far
+	cassette []MyRecording     // recordings to replay offline, nil when running live
+	used     []bool            // which recordings have been replayed
+	log      io.Writer         // where the outcome of each step is printed
+	// exec runs rs-api with the args and returns its stdout and exit code
+	exec  func(args []string) (string, int, error)
+	sleep func(time.Duration)
+}
+
+// execSelf runs the rs-api executable itself
+func execSelf(args []string) (string, int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", 0, err
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command(self, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, os.Stderr
+	err = cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), ee.ExitCode(), nil
+	}
+	return stdout.String(), 0, err
+}
+
+// run runs the steps, stopping at the first failure since later steps usually depend on
+// earlier ones, and then all the cleanup steps, it returns the number of failed steps
+func (r *scenarioRunner) run(sc *scenario) int {
+	failed := 0
+	for _, s := range sc.Steps {
+		if !r.report(s) {
+			failed++
+			break
+		}
+	}
+	for _, s := range sc.Cleanup {
+		if !r.report(s) {
+			failed++
+		}
+	}
+	return failed
+}
+
+// report runs a step and prints its outcome
+func (r *scenarioRunner) report(s scenarioStep) bool {
+	if s.If != "" && r.vars[s.If] == "" {
+		fmt.Fprintf(r.log, "skip %s: %s is empty\n", s.name(), s.If)
+		return true
+	}
+	if err := r.step(s); err != nil {
+		fmt.Fprintf(r.log, "FAIL %s: %s\n", s.name(), err.Error())
+		return false
+	}
+	fmt.Fprintf(r.log, "ok   %s\n", s.name())
+	return true
+}
+
+var reScenarioVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expand replaces the ${name} references to variables
+func (r *scenarioRunner) expand(s string) (string, error) {
+	var err error
+	res := reScenarioVar.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		v, ok := r.vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("variable %s is not set", name)
+		}
+		return v
+	})
+	return res, err
+}
+
+// step runs one step, polling if necessary, and captures its output
+func (r *scenarioRunner) step(s scenarioStep) error {
+	args := []string{}
+	if s.capturesLocation() {
+		args = append(args, "--xh", "location")
+	}
+	for _, a := range append(append(append([]string{}, s.Flags...), s.Action, s.Href),
+		s.Params...) {
+		a, err := r.expand(a)
+		if err != nil {
+			return err
+		}
+		args = append(args, a)
+	}
+	until, err := r.expand(s.Until)
+	if err != nil {
+		return err
+	}
+	attempts := s.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	interval, _ := time.ParseDuration(s.Interval)
+
+	var stdout string
+	for attempt := 1; ; attempt++ {
+		var out string
+		var exit int
+		var err error
+		if r.cassette != nil {
+			out, exit, err = r.replay(args)
+			if errors.Is(err, errNotRecorded) && attempt > 1 {
+				break // polling ends with the recorded attempts, keep the last output
+			}
+		} else {
+			out, exit, err = r.exec(append(append([]string{}, r.global...), args...))
+		}
+		if err != nil {
+			return err
+		}
+		stdout = out
+		if expected := s.Exit; !expectedExit(expected, exit) {
+			if len(expected) == 0 {
+				expected = []int{0}
+			}
+			return fmt.Errorf("exit code %d, expected %v", exit, expected)
+		}
+		if s.Until == "" || strings.TrimSpace(stdout) == until {
+			break
+		}
+		if attempt >= attempts && r.cassette == nil {
+			return fmt.Errorf("output is still %q after %d attempts",
+				strings.TrimSpace(stdout), attempts)
+		}
+		if r.cassette == nil {
+			r.sleep(interval)
+		}
+	}
+	if s.Lines > 0 {
+		n := 0
+		if out := strings.TrimSpace(stdout); out != "" {
+			n = strings.Count(out, "\n") + 1
+		}
+		if n != s.Lines {
+			return fmt.Errorf("%d lines of output, expected %d", n, s.Lines)
+		}
+	}
+
+	for name, what := range s.Capture {
+		lines := strings.SplitN(stdout, "\n", 2)
+		switch {
+		case what == "location":
+			r.vars[name] = lines[0]
+		case s.capturesLocation() && len(lines) == 2:
+			r.vars[name] = strings.TrimSpace(lines[1])
+		case s.capturesLocation():
+			r.vars[name] = ""
+		default:
+			r.vars[name] = strings.TrimSpace(stdout)
+		}
+	}
+	return nil
+}
+
+// expectedExit returns whether the exit code is one of the expected ones
+func expectedExit(expected []int, exit int) bool {
+	if len(expected) == 0 {
+		return exit == 0
+	}
+	for _, e := range expected {
+		if e == exit {
+			return true
+		}
+	}
+	return false
+}
+
+var errNotRecorded = errors.New("no recording of")
+
+// replay runs a step offline using the next unused recording of the command in the cassette
+// and checks that the output and exit code haven't changed
+func (r *scenarioRunner) replay(args []string) (string, int, error) {
+	cmdArgs := withoutKey(captureCmdArgs(args))
+	found := -1
+	for i, rec := range r.cassette {
+		if !r.used[i] && reflect.DeepEqual(withoutKey(rec.CmdArgs), cmdArgs) {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		return "", 0, fmt.Errorf("%w rs-api %s", errNotRecorded, strings.Join(args, " "))
+	}
+	r.used[found] = true
+	rec := r.cassette[found]
+
+	f, err := ioutil.TempFile("", "rs-api-scenario")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+	err = encodeRecording(f, rec)
+	f.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	flags := []string{"--replay", f.Name()}
+	if len(rec.Interactions) == 0 || !isOAuthURI(rec.Interactions[0].Uri) {
+		flags = append(flags, "--rl10")
+	}
+	stdout, exit, err := r.exec(append(flags, args...))
+	switch {
+	case err != nil:
+		return "", 0, err
+	case exit != rec.ExitCode:
+		return "", 0, fmt.Errorf("exit code %d, recorded %d", exit, rec.ExitCode)
+	case stdout != rec.Stdout:
+		return "", 0, fmt.Errorf("output %q, recorded %q", stdout, rec.Stdout)
+	}
+	return stdout, exit, nil
+}
+
+// isOAuthURI returns whether the uri is that of the oauth2 authentication request
+func isOAuthURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Path == "/api/oauth2"
+}
+
+// withoutKey removes the --key flag, which recordings replace by a fake one anyway
+func withoutKey(args []string) []string {
+	res := []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--key" {
+			i++
+			continue
+		}
+		res = append(res, args[i])
+	}
+	return res
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scenarios", func() {
+
+	var runner *scenarioRunner
+	var log bytes.Buffer
+	var executed [][]string
+	var outputs []string // stdout of the successive commands, "!n" for exit code n
+
+	BeforeEach(func() {
+		log.Reset()
+		executed, outputs = nil, nil
+		runner = &scenarioRunner{vars: map[string]string{"name": "test"}, log: &log,
+			global: []string{"--key", "secret"},
+			exec: func(args []string) (string, int, error) {
+				executed = append(executed, args)
+				out := outputs[0]
+				outputs = outputs[1:]
+				if strings.HasPrefix(out, "!") {
+					return "", int(out[1] - '0'), nil
+				}
+				return out, 0, nil
+			},
+			sleep: func(time.Duration) {},
+		}
+	})
+
+	It("runs steps capturing locations and output", func() {
+		outputs = []string{"/api/deployments/1\n", "/api/clouds/1\n"}
+		failed := runner.run(&scenario{Steps: []scenarioStep{
+			{Action: "create", Href: "deployments", Params: []string{"deployment[name]=${name}"},
+				Capture: map[string]string{"dep": "location"}},
+			{Flags: []string{"--x1", ".href"}, Action: "show", Href: "${dep}",
+				Capture: map[string]string{"cloud": "output"}},
+		}})
+		Ω(failed).Should(Equal(0))
+		Ω(executed).Should(Equal([][]string{
+			{"--key", "secret", "--xh", "location", "create", "deployments",
+				"deployment[name]=test"},
+			{"--key", "secret", "--x1", ".href", "show", "/api/deployments/1"},
+		}))
+		Ω(runner.vars).Should(HaveKeyWithValue("cloud", "/api/clouds/1"))
+		Ω(log.String()).Should(Equal("ok   create deployments\nok   show ${dep}\n"))
+	})
+
+	It("stops at the first failure but cleans up", func() {
+		outputs = []string{"!1", "!0"}
+		failed := runner.run(&scenario{
+			Steps: []scenarioStep{
+				{Name: "a", Action: "show", Href: "clouds"},
+				{Name: "b", Action: "show", Href: "clouds"},
+			},
+			Cleanup: []scenarioStep{
+				{Name: "c", Action: "destroy", Href: "${missing}"},
+				{Name: "d", Action: "destroy", Href: "x", If: "missing"},
+				{Name: "e", Action: "destroy", Href: "x"},
+			},
+		})
+		Ω(failed).Should(Equal(2))
+		Ω(log.String()).Should(Equal("FAIL a: exit code 1, expected [0]\n" +
+			"FAIL c: variable missing is not set\nskip d: missing is empty\nok   e\n"))
+	})
+
+	It("polls until the output matches", func() {
+		outputs = []string{"pending\n", "booting\n", "operational\n"}
+		step := scenarioStep{Action: "show", Href: "i", Until: "operational", Attempts: 3}
+		Ω(runner.step(step)).Should(Succeed())
+		Ω(executed).Should(HaveLen(3))
+
+		outputs = []string{"pending\n", "pending\n"}
+		step.Attempts = 2
+		Ω(runner.step(step)).Should(MatchError(`output is still "pending" after 2 attempts`))
+	})
+
+	It("replays steps from the recordings of the same commands", func() {
+		runner.cassette = []MyRecording{
+			{CmdArgs: []string{"--key", "test-key", "show", "i"}, Stdout: "pending\n",
+				Interactions: []RequestRecording{{Verb: "GET", Uri: "http://h/api/i"}}},
+			{CmdArgs: []string{"--key", "test-key", "show", "i"}, Stdout: "booting\n"},
+			{CmdArgs: []string{"--key", "test-key", "index", "clouds"}, Stdout: "[]",
+				Interactions: []RequestRecording{{Verb: "POST", Uri: "https://h/api/oauth2"}}},
+		}
+		runner.used = make([]bool, 3)
+		var replayed []string
+		runner.exec = func(args []string) (string, int, error) {
+			executed = append(executed, args)
+			recs, err := readCassette(args[1])
+			Ω(err).ShouldNot(HaveOccurred())
+			replayed = append(replayed, recs[0].Stdout)
+			return recs[0].Stdout, 0, nil
+		}
+
+		// polling ends with the recorded attempts, capturing the last output
+		Ω(runner.step(scenarioStep{Action: "show", Href: "i", Until: "operational",
+			Attempts: 5, Capture: map[string]string{"state": "output"}})).Should(Succeed())
+		Ω(replayed).Should(Equal([]string{"pending\n", "booting\n"}))
+		Ω(runner.vars).Should(HaveKeyWithValue("state", "booting"))
+		Ω(executed[0][2:]).Should(Equal([]string{"--rl10", "show", "i"}))
+
+		Ω(runner.step(scenarioStep{Action: "index", Href: "clouds"})).Should(Succeed())
+		Ω(executed[2][2:]).Should(Equal([]string{"index", "clouds"}))
+
+		Ω(runner.step(scenarioStep{Action: "index", Href: "clouds"})).Should(MatchError(
+			"no recording of rs-api index clouds"))
+	})
+
+	It("reports output that differs from the recording", func() {
+		runner.cassette = []MyRecording{{CmdArgs: []string{"show", "i"}, Stdout: "old"}}
+		runner.used = make([]bool, 1)
+		outputs = []string{"new"}
+		Ω(runner.step(scenarioStep{Action: "show", Href: "i"})).Should(MatchError(
+			`output "new", recorded "old"`))
+	})
+
+	It("checks the number of lines of output", func() {
+		outputs = []string{"a\nb\n", "a\n", ""}
+		step := scenarioStep{Action: "index", Href: "clouds", Lines: 2}
+		Ω(runner.step(step)).Should(Succeed())
+		Ω(runner.step(step)).Should(MatchError("1 lines of output, expected 2"))
+		Ω(runner.step(step)).Should(MatchError("0 lines of output, expected 2"))
+	})
+
+	It("checks scenario files", func() {
+		f, _ := ioutil.TempFile("", "scenario")
+		defer os.Remove(f.Name())
+		f.WriteString(`{"steps":[{"action":"show","href":"x","capture":{"v":"header"}}]}`)
+		f.Close()
+		_, err := readScenario(f.Name())
+		Ω(err).Should(MatchError(ContainSubstring(
+			"step 'show x' captures v from 'header', expected output or location")))
+
+		_, err = readScenario("recording_scenario.json")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("replays the scenario that records the fixtures", func() {
+		sc, err := readScenario("recording_scenario.json")
+		Ω(err).ShouldNot(HaveOccurred())
+		runner.cassette, err = readCassette("recording.json")
+		Ω(err).ShouldNot(HaveOccurred())
+		runner.used = make([]bool, len(runner.cassette))
+		runner.vars = sc.Vars
+
+		// run main() instead of the rs-api executable, like recording_test.go does
+		runner.exec = func(args []string) (string, int, error) {
+			os.Args = append([]string{"rs-api"}, args...)
+			stdout := bytes.Buffer{}
+			osStdout = &stdout
+			exitCode := 0
+			osExit = func(code int) { exitCode = code }
+			rsClientInternal = nil
+			main()
+			return stdout.String(), exitCode, nil
+		}
+
+		Ω(runner.run(sc)).Should(Equal(0), log.String())
+		Ω(log.String()).ShouldNot(ContainSubstring("FAIL"))
+
+		// all recordings are made by the scenario except the hand-written ones
+		handWritten := map[string]bool{
+			"--key test-key --jsonl index /api/clouds": true, // direct, authenticating first
+			"--key test-key --x1 .name show self":      true,
+		}
+		for i, used := range runner.used {
+			cmd := strings.Join(runner.cassette[i].CmdArgs, " ")
+			Ω(used || handWritten[cmd]).Should(BeTrue(), "the scenario doesn't make "+cmd)
+		}
+	})
+})
@@ -0,0 +1,94 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+//===== Template output
+
+// The response can be printed using a Go text/template, for example
+// '{{.name}} {{range .public_ip_addresses}}{{.}} {{end}}', which is handy to glue a few
+// fields together without having to make multiple extraction calls. The template is executed
+// with the decoded json response, i.e. a map for a single resource and an array for a
+// collection. A few helper functions are available, see templateFuncs.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// time formats used by the RightScale API, tried in order when parsing timestamps
+var apiTimeFormats = []string{
+	"2006/01/02 15:04:05 -0700", // API 1.5
+	time.RFC3339,                // API 1.6
+}
+
+var templateFuncs = template.FuncMap{
+	// rel returns the href of the named link of a resource: {{rel "parent" .}}
+	"rel": func(rel string, v interface{}) string {
+		data, _ := v.(map[string]interface{})
+		return findRel(rel, data)
+	},
+	// json prints the value as json: {{json .links}}
+	"json": func(v interface{}) (string, error) {
+		js, err := json.Marshal(v)
+		return string(js), err
+	},
+	// join joins the elements of a list: {{join "," .public_ip_addresses}}
+	"join": func(sep string, v interface{}) (string, error) {
+		l, ok := v.([]interface{})
+		if !ok && v != nil {
+			return "", fmt.Errorf("join: %T is not a list", v)
+		}
+		s := make([]string, len(l))
+		for i, e := range l {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, sep), nil
+	},
+	// time reformats an API timestamp using a Go time layout: {{time "Jan 2" .created_at}}
+	"time": func(layout string, v interface{}) (string, error) {
+		t, err := parseAPITime(v)
+		if err != nil {
+			return "", err
+		}
+		return t.Format(layout), nil
+	},
+	// since returns the time elapsed since an API timestamp: {{since .updated_at}}
+	"since": func(v interface{}) (string, error) {
+		t, err := parseAPITime(v)
+		if err != nil {
+			return "", err
+		}
+		return time.Since(t).Truncate(time.Second).String(), nil
+	},
+}
+
+// parseAPITime parses a timestamp as returned by the API
+func parseAPITime(v interface{}) (time.Time, error) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%v is not a timestamp", v)
+	}
+	for _, f := range apiTimeFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse timestamp '%s'", s)
+}
+
+// renderTemplate executes the template text with the decoded json response
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("output").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Template output", func() {
+
+	var data interface{}
+
+	BeforeEach(func() {
+		var err error
+		data, err = parseResponseBody(strings.NewReader(`{"name":"web","id":12345678901,
+			"public_ip_addresses":["1.2.3.4","5.6.7.8"],
+			"created_at":"2015/03/08 15:44:32 +0000",
+			"links":[{"rel":"self","href":"/api/servers/1"},{"rel":"parent","href":"/api/x"}]}`))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("glues fields together", func() {
+		out, err := renderTemplate(
+			`{{.name}} {{.id}} {{range .public_ip_addresses}}{{.}} {{end}}`, data)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("web 12345678901 1.2.3.4 5.6.7.8 "))
+	})
+
+	It("provides helper functions", func() {
+		out, err := renderTemplate(`{{rel "parent" .}}|{{join "," .public_ip_addresses}}|`+
+			`{{json .name}}|{{time "2006-01-02" .created_at}}`, data)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(`/api/x|1.2.3.4,5.6.7.8|"web"|2015-03-08`))
+	})
+
+	It("iterates over collections", func() {
+		coll, _ := parseResponseBody(strings.NewReader(`[{"name":"a"},{"name":"b"}]`))
+		out, err := renderTemplate("{{range .}}{{.name}}\n{{end}}", coll)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal("a\nb\n"))
+	})
+
+	It("reports template errors", func() {
+		_, err := renderTemplate(`{{time "2006" .name}}`, data)
+		Ω(err).Should(HaveOccurred())
+	})
+
+})
@@ -0,0 +1,14 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os"
+
+// terminalWidth returns the width of the terminal connected to the file, or 0 if it's not a
+// terminal or the platform doesn't tell us
+func terminalWidth(f *os.File) int {
+	return 0
+}